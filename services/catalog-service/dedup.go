@@ -0,0 +1,6 @@
+package main
+
+import "github.com/superlive/shared/hashindex"
+
+// hashes is the upload service's content-hash index on the shared media volume
+var hashes = hashindex.New(mediaDir)
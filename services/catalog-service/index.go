@@ -0,0 +1,508 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/superlive/shared/videometa"
+)
+
+// How often the media directory is rescanned to pick up new and removed files
+const indexRefreshInterval = 10 * time.Second
+
+// Page sizes for GET /files. Without limit or cursor every file is returned.
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// fileIndex is the in-memory set of catalog files, with metadata merged in,
+// that list queries are answered from
+type fileIndex struct {
+	files map[string]FileInfo
+	// IDs put or removed while refresh walks the media directory, which may
+	// have seen them before the change; nil while no refresh is running
+	changed map[string]bool
+	mu      sync.RWMutex
+}
+
+var catalogIndex = &fileIndex{files: make(map[string]FileInfo)}
+
+// refresh rebuilds the index from the media directory. Files put or removed
+// during the walk keep their current entry, so a file trashed meanwhile does
+// not reappear. Only one refresh runs at a time.
+func (ix *fileIndex) refresh() error {
+	ix.mu.Lock()
+	ix.changed = make(map[string]bool)
+	ix.mu.Unlock()
+
+	files, err := getAvailableFiles()
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	changed := ix.changed
+	ix.changed = nil
+	if err != nil {
+		return err
+	}
+
+	byID := make(map[string]FileInfo, len(files))
+	for _, file := range files {
+		byID[file.ID] = file
+	}
+	for id := range changed {
+		if file, ok := ix.files[id]; ok {
+			byID[id] = file
+		} else {
+			delete(byID, id)
+		}
+	}
+	ix.files = byID
+	return nil
+}
+
+// get returns an indexed file
+func (ix *fileIndex) get(id string) (FileInfo, bool) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	file, ok := ix.files[id]
+	return file, ok
+}
+
+// put adds or replaces a file, e.g. after its metadata changed
+func (ix *fileIndex) put(file FileInfo) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	ix.files[file.ID] = file
+	if ix.changed != nil {
+		ix.changed[file.ID] = true
+	}
+}
+
+// remove drops a file from the index
+func (ix *fileIndex) remove(id string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	delete(ix.files, id)
+	if ix.changed != nil {
+		ix.changed[id] = true
+	}
+}
+
+// watchMediaDir keeps the index in sync with the media directory
+func watchMediaDir() {
+	ticker := time.NewTicker(indexRefreshInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := catalogIndex.refresh(); err != nil {
+			log.Printf("Error refreshing file index: %v", err)
+		}
+	}
+}
+
+// lookupFile returns a file from the index, falling back to the media
+// directory for files uploaded since the last refresh
+func lookupFile(fileID string) (FileInfo, error) {
+	if file, ok := catalogIndex.get(fileID); ok {
+		return file, nil
+	}
+
+	file, err := getFileInfo(fileID)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	catalogIndex.put(file)
+	return file, nil
+}
+
+// fileQuery holds the filters, sort order and page requested from GET /files
+type fileQuery struct {
+	Terms         []string
+	MimeTypes     []string
+	Tag           string
+	Owner         string
+	Visibility    string
+	MinSize       int64
+	MaxSize       int64
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Sort          string
+	Descending    bool
+	Limit         int       // 0 returns every match
+	After         *FileInfo // sort position of the previous page's last file
+}
+
+// fileCursor identifies the last file of a page. It carries the sort value so
+// the next page can be found even if that file has since been removed.
+type fileCursor struct {
+	Sort       string `json:"s"`
+	Descending bool   `json:"d,omitempty"`
+	Value      string `json:"v"`
+	ID         string `json:"id"`
+}
+
+// parseFileQuery reads the GET /files query parameters
+func parseFileQuery(values url.Values) (fileQuery, error) {
+	q := fileQuery{
+		Terms:      strings.Fields(strings.ToLower(values.Get("q"))),
+		Tag:        strings.ToLower(strings.TrimSpace(values.Get("tag"))),
+		Owner:      values.Get("owner"),
+		Visibility: values.Get("visibility"),
+		Sort:       "created_at",
+		Descending: true,
+	}
+
+	if mimeTypes := values.Get("mime_type"); mimeTypes != "" {
+		for _, mimeType := range strings.Split(mimeTypes, ",") {
+			q.MimeTypes = append(q.MimeTypes, strings.TrimSpace(mimeType))
+		}
+	}
+
+	var err error
+	if q.MinSize, err = parseSizeParam(values, "min_size"); err != nil {
+		return q, err
+	}
+	if q.MaxSize, err = parseSizeParam(values, "max_size"); err != nil {
+		return q, err
+	}
+	if q.CreatedAfter, err = parseTimeParam(values, "created_after"); err != nil {
+		return q, err
+	}
+	if q.CreatedBefore, err = parseTimeParam(values, "created_before"); err != nil {
+		return q, err
+	}
+
+	// sort=name sorts ascending, sort=-name descending
+	if s := values.Get("sort"); s != "" {
+		q.Descending = strings.HasPrefix(s, "-")
+		q.Sort = strings.TrimPrefix(s, "-")
+		if !sortFields[q.Sort] {
+			return q, fmt.Errorf("cannot sort by %q", q.Sort)
+		}
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		q.Limit, err = strconv.Atoi(limit)
+		if err != nil || q.Limit < 1 || q.Limit > maxPageSize {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+	}
+
+	if token := values.Get("cursor"); token != "" {
+		c, err := decodeCursor(token)
+		if err != nil {
+			return q, fmt.Errorf("invalid cursor")
+		}
+		if c.Sort != q.Sort || c.Descending != q.Descending {
+			return q, fmt.Errorf("cursor does not match the requested sort order")
+		}
+		pivot, err := cursorFile(c)
+		if err != nil {
+			return q, fmt.Errorf("invalid cursor")
+		}
+		q.After = &pivot
+		if q.Limit == 0 {
+			q.Limit = defaultPageSize
+		}
+	}
+
+	return q, nil
+}
+
+// parseSizeParam parses an optional non-negative byte count
+func parseSizeParam(values url.Values, name string) (int64, error) {
+	value := values.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative number of bytes", name)
+	}
+	return size, nil
+}
+
+// parseTimeParam parses an optional RFC 3339 timestamp
+func parseTimeParam(values url.Values, name string) (time.Time, error) {
+	value := values.Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC 3339 timestamp", name)
+	}
+	return t, nil
+}
+
+// sortFields are the fields GET /files can be sorted by
+var sortFields = map[string]bool{
+	"created_at": true,
+	"updated_at": true,
+	"name":       true,
+	"title":      true,
+	"size":       true,
+}
+
+// search returns one page of matching files and the cursor of the next page,
+// which is empty on the last page. total is the number of matching files.
+func (ix *fileIndex) search(q fileQuery) (page []FileInfo, next string, total int) {
+	ix.mu.RLock()
+	var matches []FileInfo
+	for _, file := range ix.files {
+		if q.matches(file) {
+			matches = append(matches, file)
+		}
+	}
+	ix.mu.RUnlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		return q.less(matches[i], matches[j])
+	})
+	total = len(matches)
+
+	start := 0
+	if q.After != nil {
+		start = sort.Search(len(matches), func(i int) bool {
+			return q.less(*q.After, matches[i])
+		})
+	}
+
+	end := start + q.Limit
+	if q.Limit == 0 || end >= len(matches) {
+		return matches[start:], "", total
+	}
+
+	page = matches[start:end]
+	last := page[len(page)-1]
+	return page, encodeCursor(fileCursor{
+		Sort:       q.Sort,
+		Descending: q.Descending,
+		Value:      sortValue(last, q.Sort),
+		ID:         last.ID,
+	}), total
+}
+
+// matches reports whether a file passes every filter of the query
+func (q fileQuery) matches(file FileInfo) bool {
+	if len(q.Terms) > 0 {
+		text := strings.ToLower(file.Name + " " + file.Title)
+		for _, term := range q.Terms {
+			if !strings.Contains(text, term) {
+				return false
+			}
+		}
+	}
+
+	if len(q.MimeTypes) > 0 {
+		found := false
+		for _, mimeType := range q.MimeTypes {
+			if file.MimeType == mimeType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if q.Tag != "" {
+		found := false
+		for _, tag := range file.Tags {
+			if tag == q.Tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if q.Owner != "" && file.Owner != q.Owner {
+		return false
+	}
+	// Unlisted and private files are only listed when asked for by visibility
+	if q.Visibility == "" && file.Visibility != videometa.VisibilityPublic {
+		return false
+	}
+	if q.Visibility != "" && file.Visibility != q.Visibility {
+		return false
+	}
+	if q.MinSize > 0 && file.Size < q.MinSize {
+		return false
+	}
+	if q.MaxSize > 0 && file.Size > q.MaxSize {
+		return false
+	}
+	if !q.CreatedAfter.IsZero() && file.CreatedAt.Before(q.CreatedAfter) {
+		return false
+	}
+	if !q.CreatedBefore.IsZero() && !file.CreatedAt.Before(q.CreatedBefore) {
+		return false
+	}
+
+	return true
+}
+
+// less orders files by the query's sort field, breaking ties by ID
+func (q fileQuery) less(a, b FileInfo) bool {
+	c := compareBy(a, b, q.Sort)
+	if c == 0 {
+		return a.ID < b.ID
+	}
+	if q.Descending {
+		return c > 0
+	}
+	return c < 0
+}
+
+// compareBy compares two files on a single field
+func compareBy(a, b FileInfo, field string) int {
+	switch field {
+	case "name":
+		return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	case "title":
+		return strings.Compare(strings.ToLower(a.Title), strings.ToLower(b.Title))
+	case "size":
+		switch {
+		case a.Size < b.Size:
+			return -1
+		case a.Size > b.Size:
+			return 1
+		}
+		return 0
+	case "updated_at":
+		return compareTimes(a.UpdatedAt, b.UpdatedAt)
+	default:
+		return compareTimes(a.CreatedAt, b.CreatedAt)
+	}
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+// sortValue returns the value of a file's sort field as stored in a cursor
+func sortValue(file FileInfo, field string) string {
+	switch field {
+	case "name":
+		return file.Name
+	case "title":
+		return file.Title
+	case "size":
+		return fmt.Sprintf("%d", file.Size)
+	case "updated_at":
+		return file.UpdatedAt.Format(time.RFC3339Nano)
+	default:
+		return file.CreatedAt.Format(time.RFC3339Nano)
+	}
+}
+
+// cursorFile rebuilds the sort position stored in a cursor as a FileInfo
+func cursorFile(c fileCursor) (FileInfo, error) {
+	file := FileInfo{ID: c.ID}
+
+	var err error
+	switch c.Sort {
+	case "name":
+		file.Name = c.Value
+	case "title":
+		file.Title = c.Value
+	case "size":
+		_, err = fmt.Sscanf(c.Value, "%d", &file.Size)
+	case "updated_at":
+		file.UpdatedAt, err = time.Parse(time.RFC3339Nano, c.Value)
+	default:
+		file.CreatedAt, err = time.Parse(time.RFC3339Nano, c.Value)
+	}
+	return file, err
+}
+
+// encodeCursor serializes a cursor into an opaque URL-safe token
+func encodeCursor(c fileCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses a token produced by encodeCursor
+func decodeCursor(token string) (fileCursor, error) {
+	var c fileCursor
+
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
+
+// getAvailableFiles walks the media directory and returns every catalog file
+func getAvailableFiles() ([]FileInfo, error) {
+	var files []FileInfo
+
+	err := filepath.WalkDir(mediaDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Skip directories, and hidden ones such as the upload hash index entirely
+		if d.IsDir() {
+			if path != mediaDir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Get file info
+		fileInfo, err := d.Info()
+		if os.IsNotExist(err) {
+			// Removed while walking
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Skip hidden files such as uploads still being written, and files
+		// that don't match our naming convention
+		if !isCatalogFile(fileInfo.Name()) {
+			return nil
+		}
+
+		// Files in subdirectories are identified by their path relative to the
+		// media directory, as the encoding service names their source files
+		rel, err := filepath.Rel(mediaDir, path)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, newFileInfo(filepath.ToSlash(rel), fileInfo))
+		return nil
+	})
+
+	return files, err
+}
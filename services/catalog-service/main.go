@@ -7,34 +7,78 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/superlive/shared/safepath"
 )
 
 const (
 	// Using the same upload directory as the upload service
 	mediaDir = "./media"
+
+	// Default location of the metadata store
+	defaultMetadataStorePath = "./data/metadata.json"
 )
 
 type FileInfo struct {
-	ID        string    `json:"id"`
-	Name      string    `json:"name"`
-	Size      int64     `json:"size"`
-	MimeType  string    `json:"mime_type"`
-	CreatedAt time.Time `json:"created_at"`
-	URL       string    `json:"url"`
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Size        int64      `json:"size"`
+	MimeType    string     `json:"mime_type"`
+	CreatedAt   time.Time  `json:"created_at"`
+	URL         string     `json:"url"`
+	Title       string     `json:"title"`
+	Description string     `json:"description,omitempty"`
+	Tags        []string   `json:"tags"`
+	Owner       string     `json:"owner,omitempty"`
+	Visibility  string     `json:"visibility"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	PurgeAt     *time.Time `json:"purge_at,omitempty"`
 }
 
+var (
+	// Persistent metadata store
+	metadataStore MetadataStore
+
+	// Serializes read-modify-write updates of metadata records
+	metadataMutex sync.Mutex
+)
+
 func main() {
 	// Ensure the media directory exists
 	if err := os.MkdirAll(mediaDir, 0755); err != nil {
 		log.Fatalf("Failed to create media directory: %v", err)
 	}
 
+	// Open the metadata store
+	store, err := openFileStore(getEnv("METADATA_STORE_PATH", defaultMetadataStorePath))
+	if err != nil {
+		log.Fatalf("Failed to open metadata store: %v", err)
+	}
+	metadataStore = store
+
+	// Build the file index and keep it in sync with the media directory
+	if err := catalogIndex.refresh(); err != nil {
+		log.Printf("Error building file index: %v", err)
+	}
+	go watchMediaDir()
+
+	// Purge files that have been in the trash longer than the retention period
+	go purgeExpiredTrash()
+
 	// Set up HTTP server with CORS middleware
 	mux := http.NewServeMux()
 	mux.HandleFunc("/files", listFilesHandler)
+	mux.HandleFunc("/files/", fileHandler)
+	mux.HandleFunc("/videos", listVideosHandler)
+	mux.HandleFunc("/videos/", videoHandler)
+	mux.HandleFunc("/trash", listTrashHandler)
 	mux.HandleFunc("/download/", downloadFileHandler)
 	mux.HandleFunc("/health", healthCheckHandler)
 
@@ -72,8 +116,9 @@ func corsMiddleware(next http.Handler) http.Handler {
 			w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
 		}
 
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding")
+		w.Header().Set("Access-Control-Expose-Headers", "Link, X-Total-Count")
 
 		// Handle preflight OPTIONS request
 		if r.Method == http.MethodOptions {
@@ -92,17 +137,33 @@ func listFilesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	files, err := getAvailableFiles()
+	query, err := parseFileQuery(r.URL.Query())
 	if err != nil {
-		http.Error(w, "Error retrieving files", http.StatusInternalServerError)
-		log.Printf("Error retrieving files: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	files, next, total := catalogIndex.search(query)
+	if files == nil {
+		files = []FileInfo{}
+	}
+
+	setPageHeaders(w, r, "/files", next, total)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(files)
 }
 
+// setPageHeaders links to the next page with the same filters, RFC 8288 style,
+// and reports the total number of matches
+func setPageHeaders(w http.ResponseWriter, r *http.Request, path, next string, total int) {
+	if next != "" {
+		values := r.URL.Query()
+		values.Set("cursor", next)
+		w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", path, values.Encode()))
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+}
+
 func downloadFileHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -117,14 +178,18 @@ func downloadFileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Find the file path
-	filePath := filepath.Join(mediaDir, fileID)
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		http.Error(w, "File not found", http.StatusNotFound)
+	filePath, err := safepath.Resolve(mediaDir, fileID)
+	if err == safepath.ErrUnsafe {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
 		return
 	}
 
-	// Get file information
+	// Get file information; only catalog files can be downloaded
 	fileInfo, err := os.Stat(filePath)
+	if os.IsNotExist(err) || (err == nil && (!fileInfo.Mode().IsRegular() || !isCatalogFile(fileInfo.Name()))) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error retrieving file info", http.StatusInternalServerError)
 		log.Printf("Error retrieving file info: %v", err)
@@ -147,52 +212,64 @@ func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
 }
 
-func getAvailableFiles() ([]FileInfo, error) {
-	var files []FileInfo
-
-	err := filepath.WalkDir(mediaDir, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// Skip directories
-		if d.IsDir() {
-			return nil
-		}
+// getFileInfo returns a single file with its metadata
+func getFileInfo(fileID string) (FileInfo, error) {
+	if !isCatalogFile(path.Base(fileID)) {
+		return FileInfo{}, os.ErrNotExist
+	}
+	filePath, err := safepath.Resolve(mediaDir, fileID)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if info.IsDir() || !isCatalogFile(info.Name()) {
+		return FileInfo{}, os.ErrNotExist
+	}
+	return newFileInfo(fileID, info), nil
+}
 
-		// Get file info
-		fileInfo, err := d.Info()
-		if err != nil {
-			return err
-		}
+// newFileInfo combines a file on disk with its stored metadata
+func newFileInfo(fileID string, info fs.FileInfo) FileInfo {
+	meta, exists := metadataStore.Get(fileID)
+	if !exists {
+		meta = defaultMetadata(fileID, info.ModTime())
+	}
 
-		filename := fileInfo.Name()
-		// Extract timestamp and original filename
-		parts := strings.SplitN(filename, "_", 2)
-		if len(parts) != 2 {
-			// Skip files that don't match our naming convention
-			return nil
-		}
+	tags := meta.Tags
+	if tags == nil {
+		tags = []string{}
+	}
 
-		originalFilename := parts[1]
-		size := fileInfo.Size()
-		contentType := getContentTypeFromFilename(filename)
-
-		// Create file metadata
-		file := FileInfo{
-			ID:        filename,
-			Name:      originalFilename,
-			Size:      size,
-			MimeType:  contentType,
-			CreatedAt: fileInfo.ModTime(),
-			URL:       fmt.Sprintf("/download/%s", filename),
-		}
+	file := FileInfo{
+		ID:          fileID,
+		Name:        getOriginalFilename(fileID),
+		Size:        info.Size(),
+		MimeType:    getContentTypeFromFilename(fileID),
+		CreatedAt:   info.ModTime(),
+		URL:         fmt.Sprintf("/download/%s", fileID),
+		Title:       meta.Title,
+		Description: meta.Description,
+		Tags:        tags,
+		Owner:       meta.Owner,
+		Visibility:  meta.Visibility,
+		UpdatedAt:   meta.UpdatedAt,
+	}
 
-		files = append(files, file)
-		return nil
-	})
+	if meta.DeletedAt != nil {
+		purgeAt := meta.DeletedAt.Add(trashRetention)
+		file.DeletedAt = meta.DeletedAt
+		file.PurgeAt = &purgeAt
+	}
+	return file
+}
 
-	return files, err
+// isCatalogFile reports whether a media file name follows the upload service's
+// {timestamp}_{original_filename} convention and is not hidden
+func isCatalogFile(name string) bool {
+	return !strings.HasPrefix(name, ".") && strings.Contains(name, "_")
 }
 
 func getContentTypeFromFilename(filename string) string {
@@ -217,10 +294,13 @@ func getContentTypeFromFilename(filename string) string {
 	}
 }
 
+// getOriginalFilename returns the name a file was uploaded with. File IDs of
+// files in subdirectories start with their directory, which is dropped.
 func getOriginalFilename(fileID string) string {
-	parts := strings.SplitN(fileID, "_", 2)
+	name := path.Base(fileID)
+	parts := strings.SplitN(name, "_", 2)
 	if len(parts) < 2 {
-		return fileID
+		return name
 	}
 	return parts[1]
 }
@@ -231,3 +311,11 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(getEnv(key, ""))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
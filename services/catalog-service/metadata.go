@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/superlive/shared/safepath"
+	"github.com/superlive/shared/videometa"
+)
+
+// VideoMetadata is the user-editable metadata stored for an uploaded file
+type VideoMetadata struct {
+	ID          string     `json:"id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	Owner       string     `json:"owner,omitempty"`
+	Visibility  string     `json:"visibility"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"` // set while the file is in the trash
+
+	// Content hash released from the upload hash index while the file is in the trash
+	ReleasedHash string `json:"released_hash,omitempty"`
+}
+
+// defaultMetadata returns the metadata of a file that has never been edited
+func defaultMetadata(fileID string, createdAt time.Time) VideoMetadata {
+	return VideoMetadata{
+		ID:         fileID,
+		Title:      getOriginalFilename(fileID),
+		Visibility: videometa.VisibilityPublic,
+		CreatedAt:  createdAt,
+		UpdatedAt:  createdAt,
+	}
+}
+
+// applyUpdate validates the update and copies the provided fields onto meta
+func applyUpdate(meta *VideoMetadata, u videometa.Update) error {
+	if err := u.Normalize(); err != nil {
+		return err
+	}
+
+	if u.Title != nil {
+		meta.Title = *u.Title
+	}
+	if u.Description != nil {
+		meta.Description = *u.Description
+	}
+	if u.Tags != nil {
+		meta.Tags = *u.Tags
+	}
+	if u.Owner != nil {
+		meta.Owner = *u.Owner
+	}
+	if u.Visibility != nil {
+		meta.Visibility = *u.Visibility
+	}
+	return nil
+}
+
+// fileHandler routes requests for a single file under /files/{id}. IDs of
+// files in subdirectories contain slashes, so actions are matched at the end.
+func fileHandler(w http.ResponseWriter, r *http.Request) {
+	fileID := strings.TrimPrefix(r.URL.Path, "/files/")
+	if fileID == "" {
+		listFilesHandler(w, r)
+		return
+	}
+
+	if strings.HasSuffix(fileID, "/restore") {
+		restoreFileHandler(w, r, strings.TrimSuffix(fileID, "/restore"))
+		return
+	}
+	if !isCatalogFile(path.Base(fileID)) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		getFileHandler(w, r, fileID)
+	case http.MethodPatch:
+		updateFileHandler(w, r, fileID)
+	case http.MethodDelete:
+		deleteFileHandler(w, r, fileID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// getFileHandler returns a single file with its metadata
+func getFileHandler(w http.ResponseWriter, r *http.Request, fileID string) {
+	file, err := lookupFile(fileID)
+	if err == safepath.ErrUnsafe {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+	if os.IsNotExist(err) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error retrieving file info", http.StatusInternalServerError)
+		log.Printf("Error retrieving file info for %s: %v", fileID, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(file)
+}
+
+// updateFileHandler applies a partial metadata update to a file
+func updateFileHandler(w http.ResponseWriter, r *http.Request, fileID string) {
+	var update videometa.Update
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&update); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	filePath, err := safepath.Resolve(mediaDir, fileID)
+	if err == safepath.ErrUnsafe {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) || (err == nil && !isCatalogFile(info.Name())) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error retrieving file info", http.StatusInternalServerError)
+		log.Printf("Error retrieving file info for %s: %v", fileID, err)
+		return
+	}
+
+	metadataMutex.Lock()
+	meta, exists := metadataStore.Get(fileID)
+	if !exists {
+		meta = defaultMetadata(fileID, time.Now())
+	}
+
+	if err := applyUpdate(&meta, update); err != nil {
+		metadataMutex.Unlock()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	meta.UpdatedAt = time.Now()
+
+	err = metadataStore.Save(meta)
+	metadataMutex.Unlock()
+	if err != nil {
+		http.Error(w, "Error saving metadata", http.StatusInternalServerError)
+		log.Printf("Error saving metadata for %s: %v", fileID, err)
+		return
+	}
+
+	log.Printf("Updated metadata for %s", fileID)
+
+	file := newFileInfo(fileID, info)
+	catalogIndex.put(file)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(file)
+}
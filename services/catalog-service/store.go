@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// MetadataStore persists user-editable video metadata keyed by file ID
+type MetadataStore interface {
+	// Get returns the metadata stored for a file
+	Get(id string) (VideoMetadata, bool)
+	// Save inserts or replaces a record
+	Save(meta VideoMetadata) error
+	// Delete removes a record from the store
+	Delete(id string) error
+}
+
+// fileStore is a MetadataStore that keeps the records in memory and rewrites
+// a single JSON file on every change. Metadata is small and edited rarely, so
+// nothing more elaborate is needed.
+type fileStore struct {
+	path    string
+	records map[string]VideoMetadata
+	mu      sync.Mutex
+}
+
+// openFileStore loads the records saved at path, if any
+func openFileStore(path string) (*fileStore, error) {
+	s := &fileStore{
+		path:    path,
+		records: make(map[string]VideoMetadata),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata store: %w", err)
+	}
+
+	var saved []VideoMetadata
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata store: %w", err)
+	}
+	for _, meta := range saved {
+		s.records[meta.ID] = meta
+	}
+	return s, nil
+}
+
+// Get returns the record for a file ID
+func (s *fileStore) Get(id string) (VideoMetadata, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, ok := s.records[id]
+	return meta, ok
+}
+
+// Save stores the metadata and writes the store to disk
+func (s *fileStore) Save(meta VideoMetadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, existed := s.records[meta.ID]
+	s.records[meta.ID] = meta
+	if err := s.write(); err != nil {
+		if existed {
+			s.records[meta.ID] = previous
+		} else {
+			delete(s.records, meta.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes the record for a file ID and writes the store to disk
+func (s *fileStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, existed := s.records[id]
+	if !existed {
+		return nil
+	}
+	delete(s.records, id)
+	if err := s.write(); err != nil {
+		s.records[id] = previous
+		return err
+	}
+	return nil
+}
+
+// write saves every record, ordered by creation time; the caller holds s.mu
+func (s *fileStore) write() error {
+	records := make([]VideoMetadata, 0, len(s.records))
+	for _, meta := range s.records {
+		records = append(records, meta)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreatedAt.Before(records[j].CreatedAt)
+	})
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create metadata store directory: %w", err)
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated file
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write metadata store: %w", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to replace metadata store: %w", err)
+	}
+	return nil
+}
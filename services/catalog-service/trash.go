@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/superlive/shared/safepath"
+)
+
+// Deleted files are moved to trashDir until they are purged. It is hidden, so
+// neither the file index nor the encoding service's watcher sees them.
+var trashDir = filepath.Join(mediaDir, ".trash")
+
+// How long deleted files can be restored before they are purged
+var trashRetention = getEnvDuration("TRASH_RETENTION", 7*24*time.Hour)
+
+// How often expired files are purged from the trash
+const trashPurgeInterval = time.Hour
+
+// deleteFileHandler moves a file to the trash, or purges it immediately with ?permanent=true
+func deleteFileHandler(w http.ResponseWriter, r *http.Request, fileID string) {
+	permanent := r.URL.Query().Get("permanent") == "true"
+
+	mediaPath, trashPath, err := trashPaths(fileID)
+	if err == safepath.ErrUnsafe {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+	if err == nil && !isCatalogFile(path.Base(fileID)) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error deleting file", http.StatusInternalServerError)
+		log.Printf("Error resolving paths for %s: %v", fileID, err)
+		return
+	}
+
+	if permanent {
+		// Move the file out of sight first, so the encoding service's watcher
+		// cannot pick it up again while its encodings are deleted. Files already
+		// in the trash are purged early.
+		err := os.Rename(mediaPath, trashPath)
+		if os.IsNotExist(err) {
+			_, err = os.Stat(trashPath)
+		}
+		if os.IsNotExist(err) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			catalogIndex.remove(fileID)
+			err = purgeFile(fileID, trashPath)
+		}
+		if err != nil {
+			http.Error(w, "Error deleting file", http.StatusInternalServerError)
+			log.Printf("Error deleting %s: %v", fileID, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	metadataMutex.Lock()
+	info, err := os.Stat(mediaPath)
+	if os.IsNotExist(err) {
+		metadataMutex.Unlock()
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		metadataMutex.Unlock()
+		http.Error(w, "Error retrieving file info", http.StatusInternalServerError)
+		log.Printf("Error retrieving file info for %s: %v", fileID, err)
+		return
+	}
+
+	meta, exists := metadataStore.Get(fileID)
+	if !exists {
+		meta = defaultMetadata(fileID, info.ModTime())
+	}
+	now := time.Now()
+	meta.DeletedAt = &now
+
+	// Withdraw the encodings first, so a trashed file is never still playable
+	if err := setEncodingsSuspended(fileID, true); err != nil {
+		metadataMutex.Unlock()
+		http.Error(w, "Error deleting file", http.StatusInternalServerError)
+		log.Printf("Error suspending encodings of %s: %v", fileID, err)
+		return
+	}
+
+	err = os.Rename(mediaPath, trashPath)
+	if err == nil {
+		// New uploads of the same content must not be deduplicated against a trashed file
+		if meta.ReleasedHash, err = hashes.Release(fileID); err != nil {
+			log.Printf("Error releasing the content hash of %s: %v", fileID, err)
+		}
+		if err = metadataStore.Save(meta); err != nil {
+			// Put the file back so the trash never holds files without a deletion time
+			os.Rename(trashPath, mediaPath)
+			restoreHash(fileID, meta.ReleasedHash)
+		}
+	}
+	if err != nil {
+		if resumeErr := setEncodingsSuspended(fileID, false); resumeErr != nil {
+			log.Printf("Error resuming encodings of %s: %v", fileID, resumeErr)
+		}
+	}
+	metadataMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Error deleting file", http.StatusInternalServerError)
+		log.Printf("Error moving %s to the trash: %v", fileID, err)
+		return
+	}
+
+	catalogIndex.remove(fileID)
+	log.Printf("Moved %s to the trash", fileID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newFileInfo(fileID, info))
+}
+
+// restoreFileHandler moves a file out of the trash
+func restoreFileHandler(w http.ResponseWriter, r *http.Request, fileID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mediaPath, trashPath, err := trashPaths(fileID)
+	if err == safepath.ErrUnsafe {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+
+	metadataMutex.Lock()
+	info, statErr := os.Stat(trashPath)
+	if err != nil || statErr != nil || !isCatalogFile(path.Base(fileID)) {
+		metadataMutex.Unlock()
+		http.Error(w, "File not found in trash", http.StatusNotFound)
+		return
+	}
+	if _, err := os.Stat(mediaPath); err == nil {
+		metadataMutex.Unlock()
+		http.Error(w, "A file with this ID already exists", http.StatusConflict)
+		return
+	}
+
+	meta, exists := metadataStore.Get(fileID)
+	if !exists {
+		meta = defaultMetadata(fileID, info.ModTime())
+	}
+	meta.DeletedAt = nil
+	releasedHash := meta.ReleasedHash
+	meta.ReleasedHash = ""
+
+	// Bring the encodings back first, so a failure leaves the file in the trash to retry
+	if err := setEncodingsSuspended(fileID, false); err != nil {
+		metadataMutex.Unlock()
+		http.Error(w, "Error restoring file", http.StatusInternalServerError)
+		log.Printf("Error resuming encodings of %s: %v", fileID, err)
+		return
+	}
+
+	err = os.Rename(trashPath, mediaPath)
+	if err == nil {
+		err = metadataStore.Save(meta)
+		if err != nil {
+			os.Rename(mediaPath, trashPath)
+		} else {
+			restoreHash(fileID, releasedHash)
+		}
+	}
+	if err != nil {
+		if suspendErr := setEncodingsSuspended(fileID, true); suspendErr != nil {
+			log.Printf("Error suspending encodings of %s: %v", fileID, suspendErr)
+		}
+	}
+	metadataMutex.Unlock()
+
+	if err != nil {
+		http.Error(w, "Error restoring file", http.StatusInternalServerError)
+		log.Printf("Error restoring %s: %v", fileID, err)
+		return
+	}
+
+	file := newFileInfo(fileID, info)
+	catalogIndex.put(file)
+	log.Printf("Restored %s from the trash", fileID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(file)
+}
+
+// trashPaths resolves a file ID from a request to its paths in the media
+// directory and in the trash. Files in subdirectories keep their relative
+// path in the trash, so the parent directories are created in both places.
+func trashPaths(fileID string) (mediaPath, trashPath string, err error) {
+	if err := os.MkdirAll(trashDir, 0755); err != nil {
+		return "", "", err
+	}
+	if mediaPath, err = safepath.Resolve(mediaDir, fileID); err != nil {
+		return "", "", err
+	}
+	if trashPath, err = safepath.Resolve(trashDir, fileID); err != nil {
+		return "", "", err
+	}
+	for _, dir := range []string{filepath.Dir(mediaPath), filepath.Dir(trashPath)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", "", err
+		}
+	}
+	return mediaPath, trashPath, nil
+}
+
+// listTrashHandler lists deleted files that can still be restored, most recently deleted first
+func listTrashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	files, err := getTrashedFiles()
+	if err != nil {
+		http.Error(w, "Error retrieving trash", http.StatusInternalServerError)
+		log.Printf("Error retrieving trash: %v", err)
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].DeletedAt.After(*files[j].DeletedAt)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(files)
+}
+
+// getTrashedFiles returns every file in the trash with its metadata. Files
+// from subdirectories are identified by their path relative to the trash.
+func getTrashedFiles() ([]FileInfo, error) {
+	files := []FileInfo{}
+
+	err := filepath.WalkDir(trashDir, func(path string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) && path == trashDir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != trashDir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil || !info.Mode().IsRegular() || !isCatalogFile(info.Name()) {
+			// Removed while walking, or not a catalog file
+			return nil
+		}
+		rel, err := filepath.Rel(trashDir, path)
+		if err != nil {
+			return err
+		}
+
+		file := newFileInfo(filepath.ToSlash(rel), info)
+		if file.DeletedAt == nil {
+			// Left behind by a failed permanent delete, so it has no deletion
+			// time; count from its last modification instead
+			modTime := info.ModTime()
+			purgeAt := modTime.Add(trashRetention)
+			file.DeletedAt = &modTime
+			file.PurgeAt = &purgeAt
+		}
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// purgeExpiredTrash periodically purges files deleted longer than trashRetention ago
+func purgeExpiredTrash() {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		files, err := getTrashedFiles()
+		if err != nil {
+			log.Printf("Error reading trash: %v", err)
+			continue
+		}
+
+		for _, file := range files {
+			if time.Since(*file.DeletedAt) < trashRetention {
+				continue
+			}
+			if err := purgeFile(file.ID, filepath.Join(trashDir, filepath.FromSlash(file.ID))); err != nil {
+				// Retried on the next round
+				log.Printf("Error purging %s: %v", file.ID, err)
+			}
+		}
+	}
+}
+
+// purgeFile permanently deletes a file in the trash: its encodings and their
+// outputs via the encoding service, the file at trashPath, and its metadata
+func purgeFile(fileID, trashPath string) error {
+	// Remove the encodings first, so a failure leaves the file in the trash to retry
+	if err := deleteEncodingJobs(fileID); err != nil {
+		return fmt.Errorf("failed to delete encodings: %w", err)
+	}
+
+	if err := os.Remove(trashPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Files purged straight from the media directory still have their hash claimed
+	if _, err := hashes.Release(fileID); err != nil {
+		log.Printf("Error releasing the content hash of %s: %v", fileID, err)
+	}
+
+	metadataMutex.Lock()
+	err := metadataStore.Delete(fileID)
+	metadataMutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to delete metadata: %w", err)
+	}
+
+	catalogIndex.remove(fileID)
+	log.Printf("Permanently deleted %s", fileID)
+	return nil
+}
+
+// deleteEncodingJobs asks the encoding service to delete every job for a source
+// file along with its renditions, manifests and thumbnails
+func deleteEncodingJobs(sourceFile string) error {
+	return callEncodingService(http.MethodDelete, "/jobs", sourceFile)
+}
+
+// setEncodingsSuspended asks the encoding service to suspend every job for a
+// source file, withholding its streams while the file is in the trash, or to
+// resume them once it is restored
+func setEncodingsSuspended(sourceFile string, suspended bool) error {
+	if suspended {
+		return callEncodingService(http.MethodPost, "/jobs/suspend", sourceFile)
+	}
+	return callEncodingService(http.MethodPost, "/jobs/resume", sourceFile)
+}
+
+// callEncodingService sends a request about a source file's jobs to the
+// encoding service and checks that it succeeded
+func callEncodingService(method, path, sourceFile string) error {
+	query := url.Values{"source_file": {sourceFile}}
+	req, err := http.NewRequest(method, encodingServiceURL+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := encodingClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("encoding service returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// restoreHash claims the content hash a trashed file released again, once the
+// file is back in the media directory, unless another upload has claimed the
+// content meanwhile
+func restoreHash(fileID, checksum string) {
+	if checksum == "" {
+		return
+	}
+	if _, err := hashes.Claim(checksum, fileID); err != nil {
+		log.Printf("Error reclaiming the content hash of %s: %v", fileID, err)
+	}
+}
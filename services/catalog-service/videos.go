@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/superlive/shared/safepath"
+)
+
+// Settings for querying the encoding service
+var (
+	encodingServiceURL = strings.TrimRight(getEnv("ENCODING_SERVICE_URL", "http://localhost:8082"), "/")
+
+	// Base URL clients use to reach the encoding service. When set, manifest and
+	// thumbnail paths in video records are made absolute with it.
+	encodingPublicURL = strings.TrimRight(getEnv("ENCODING_PUBLIC_URL", ""), "/")
+
+	encodingClient = &http.Client{Timeout: 5 * time.Second}
+)
+
+// Video statuses derived from a file's encoding jobs
+const (
+	videoStatusReady      = "ready"       // a completed encoding is available
+	videoStatusProcessing = "processing"  // an encoding job is running
+	videoStatusPending    = "pending"     // an encoding job is queued
+	videoStatusFailed     = "failed"      // every encoding job failed or was cancelled
+	videoStatusNotEncoded = "not_encoded" // no encoding job exists
+	videoStatusUnknown    = "unknown"     // the encoding service could not be reached
+)
+
+// EncodingJob is the subset of the encoding service's job we expose
+type EncodingJob struct {
+	ID           string    `json:"id"`
+	SourceFile   string    `json:"source_file"`
+	Profile      string    `json:"profile,omitempty"`
+	Status       string    `json:"status"`
+	Progress     int       `json:"progress"`
+	ErrorMessage string    `json:"error_message,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	CompletedAt  time.Time `json:"completed_at,omitempty"`
+	DashManifest string    `json:"dash_manifest,omitempty"`
+	HlsManifest  string    `json:"hls_manifest,omitempty"`
+	Thumbnail    string    `json:"thumbnail,omitempty"`
+	Duration     float64   `json:"duration,omitempty"`
+}
+
+// Video is an uploaded file joined with the state of its encodings
+type Video struct {
+	FileInfo
+	Status       string        `json:"status"`
+	Progress     int           `json:"progress"`
+	Duration     float64       `json:"duration,omitempty"`
+	Thumbnail    string        `json:"thumbnail,omitempty"`
+	DashManifest string        `json:"dash_manifest,omitempty"`
+	HlsManifest  string        `json:"hls_manifest,omitempty"`
+	Encodings    []EncodingJob `json:"encodings"`
+}
+
+// listVideosHandler lists videos with the same filters and paging as GET /files
+func listVideosHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query, err := parseFileQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	files, next, total := catalogIndex.search(query)
+
+	sourceFiles := make([]string, len(files))
+	for i, file := range files {
+		sourceFiles[i] = file.ID
+	}
+	jobs, err := fetchEncodingJobs(sourceFiles)
+	if err != nil {
+		log.Printf("Error fetching encoding jobs: %v", err)
+	}
+
+	videos := make([]Video, 0, len(files))
+	for _, file := range files {
+		videos = append(videos, newVideo(file, jobs[file.ID], err == nil))
+	}
+
+	setPageHeaders(w, r, "/videos", next, total)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(videos)
+}
+
+// videoHandler returns a single video under /videos/{id}
+func videoHandler(w http.ResponseWriter, r *http.Request) {
+	fileID := strings.TrimPrefix(r.URL.Path, "/videos/")
+	if fileID == "" {
+		listVideosHandler(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	file, err := lookupFile(fileID)
+	if err == safepath.ErrUnsafe {
+		http.Error(w, "Invalid video ID", http.StatusBadRequest)
+		return
+	}
+	if os.IsNotExist(err) {
+		http.Error(w, "Video not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error retrieving file info", http.StatusInternalServerError)
+		log.Printf("Error retrieving file info for %s: %v", fileID, err)
+		return
+	}
+
+	jobs, err := fetchEncodingJobs([]string{fileID})
+	if err != nil {
+		log.Printf("Error fetching encoding jobs for %s: %v", fileID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newVideo(file, jobs[fileID], err == nil))
+}
+
+// newVideo joins a file with its encoding jobs. reachable is false if the
+// encoding service could not be queried, leaving the status unknown.
+func newVideo(file FileInfo, jobs []EncodingJob, reachable bool) Video {
+	video := Video{
+		FileInfo:  file,
+		Status:    videoStatusNotEncoded,
+		Encodings: []EncodingJob{},
+	}
+	if !reachable {
+		video.Status = videoStatusUnknown
+		return video
+	}
+
+	// Newest first
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.After(jobs[j].CreatedAt)
+	})
+	for i := range jobs {
+		jobs[i].DashManifest = publicEncodingURL(jobs[i].DashManifest)
+		jobs[i].HlsManifest = publicEncodingURL(jobs[i].HlsManifest)
+		jobs[i].Thumbnail = publicEncodingURL(jobs[i].Thumbnail)
+	}
+	video.Encodings = append(video.Encodings, jobs...)
+
+	// The newest completed job provides the playable outputs
+	for _, job := range jobs {
+		if job.Status == "completed" {
+			video.Status = videoStatusReady
+			video.Progress = 100
+			video.DashManifest = job.DashManifest
+			video.HlsManifest = job.HlsManifest
+			video.Thumbnail = job.Thumbnail
+			break
+		}
+	}
+
+	// Otherwise report the most advanced job still in progress
+	if video.Status != videoStatusReady {
+		for _, job := range jobs {
+			switch job.Status {
+			case "processing":
+				video.Status = videoStatusProcessing
+				video.Progress = job.Progress
+			case "pending":
+				if video.Status != videoStatusProcessing {
+					video.Status = videoStatusPending
+				}
+			}
+		}
+		if video.Status == videoStatusNotEncoded && len(jobs) > 0 {
+			video.Status = videoStatusFailed
+		}
+	}
+
+	for _, job := range jobs {
+		if job.Duration > 0 {
+			video.Duration = job.Duration
+			break
+		}
+	}
+
+	return video
+}
+
+// fetchEncodingJobs returns the encoding jobs of the given source files, keyed by file
+func fetchEncodingJobs(sourceFiles []string) (map[string][]EncodingJob, error) {
+	bySource := make(map[string][]EncodingJob)
+	if len(sourceFiles) == 0 {
+		return bySource, nil
+	}
+
+	query := url.Values{"source_file": sourceFiles}
+	resp, err := encodingClient.Get(encodingServiceURL + "/jobs?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("encoding service returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var jobs []EncodingJob
+	if err := json.NewDecoder(resp.Body).Decode(&jobs); err != nil {
+		return nil, fmt.Errorf("invalid response from encoding service: %w", err)
+	}
+
+	for _, job := range jobs {
+		bySource[job.SourceFile] = append(bySource[job.SourceFile], job)
+	}
+	return bySource, nil
+}
+
+// publicEncodingURL makes an encoding service path absolute if ENCODING_PUBLIC_URL is set
+func publicEncodingURL(path string) string {
+	if path == "" || encodingPublicURL == "" {
+		return path
+	}
+	return encodingPublicURL + path
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/superlive/shared/hashindex"
+)
+
+// hashes maps content hashes to source file IDs. It is shared with the upload
+// service on the media volume.
+var hashes = hashindex.New(mediaDir)
+
+// sourceOwners caches the indexed owner of each source file seen by the
+// watcher, so files are hashed once. Only used by the watcher goroutine.
+var sourceOwners = make(map[string]string)
+
+// sourceOwner returns the source file ID that owns the content of relPath:
+// relPath itself, or an earlier file with identical content
+func sourceOwner(relPath string) (string, error) {
+	if owner, ok := sourceOwners[relPath]; ok {
+		// Re-check if the original has been removed since
+		if _, err := os.Stat(filepath.Join(mediaDir, owner)); err == nil {
+			return owner, nil
+		}
+	}
+
+	checksum, err := hashindex.HashFile(filepath.Join(mediaDir, relPath))
+	if err != nil {
+		return "", err
+	}
+	owner, err := hashes.Claim(checksum, relPath)
+	if err != nil {
+		return "", err
+	}
+
+	sourceOwners[relPath] = owner
+	return owner, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Event types sent on GET /events
+const (
+	eventJobCreated      = "job.created"
+	eventJobStarted      = "job.started"
+	eventJobProgress     = "job.progress"
+	eventJobCompleted    = "job.completed"
+	eventJobFailed       = "job.failed"
+	eventJobCancelled    = "job.cancelled"
+	eventJobRetried      = "job.retried"
+	eventJobDeleted      = "job.deleted"
+	eventStreamPublished = "stream.published"
+)
+
+// Number of recent events kept for clients that reconnect with Last-Event-ID
+var eventBufferSize = getEnvInt("EVENT_BUFFER_SIZE", 1000)
+
+const (
+	// How often an idle event stream sends a comment so proxies keep it open
+	eventKeepAliveInterval = 15 * time.Second
+
+	// Events a slow client may fall behind before it is disconnected
+	eventSubscriberBuffer = 64
+)
+
+// event is a lifecycle event delivered to event stream clients
+type event struct {
+	ID   uint64
+	Type string
+	Data []byte // JSON payload
+}
+
+// eventBroker fans events out to subscribers and keeps the most recent ones in
+// a ring so reconnecting clients can catch up on what they missed
+type eventBroker struct {
+	mu          sync.Mutex
+	ring        []event
+	next        int    // ring index the next event is written to
+	lastID      uint64 // IDs start from the startup time, so they keep growing across restarts
+	subscribers map[chan event]struct{}
+}
+
+var events = newEventBroker(eventBufferSize)
+
+func newEventBroker(size int) *eventBroker {
+	if size < 1 {
+		size = 1
+	}
+	return &eventBroker{
+		lastID:      uint64(time.Now().UnixNano()),
+		ring:        make([]event, 0, size),
+		subscribers: make(map[chan event]struct{}),
+	}
+}
+
+// publish records an event and sends it to every subscriber. It never blocks:
+// a subscriber whose buffer is full is disconnected and has to reconnect,
+// replaying what it missed from the ring.
+func (b *eventBroker) publish(eventType string, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error encoding %s event: %v", eventType, err)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	e := event{ID: b.lastID, Type: eventType, Data: data}
+	if len(b.ring) < cap(b.ring) {
+		b.ring = append(b.ring, e)
+	} else {
+		b.ring[b.next] = e
+	}
+	b.next = (b.next + 1) % cap(b.ring)
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe registers a new subscriber and returns the buffered events after
+// lastID it has to be sent first. An ID from before a restart replays every
+// buffered event, as does one the broker has not issued.
+func (b *eventBroker) subscribe(lastID uint64) ([]event, chan event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var replay []event
+	if lastID > b.lastID {
+		lastID = 0
+	}
+	if lastID < b.lastID {
+		// Walk the ring from the oldest event
+		start := 0
+		if len(b.ring) == cap(b.ring) {
+			start = b.next
+		}
+		for i := 0; i < len(b.ring); i++ {
+			e := b.ring[(start+i)%len(b.ring)]
+			if e.ID > lastID {
+				replay = append(replay, e)
+			}
+		}
+	}
+
+	ch := make(chan event, eventSubscriberBuffer)
+	b.subscribers[ch] = struct{}{}
+	return replay, ch
+}
+
+// unsubscribe removes a subscriber, unless it was already disconnected
+func (b *eventBroker) unsubscribe(ch chan event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// publishJobEvent sends an event carrying a job's current state to event
+// stream clients and subscribed webhooks
+func publishJobEvent(eventType string, job EncodingJob) {
+	events.publish(eventType, job)
+	dispatchWebhooks(eventType, job)
+}
+
+// publishJobDeleted sends an event for a job that no longer exists
+func publishJobDeleted(jobID string) {
+	events.publish(eventJobDeleted, struct {
+		ID string `json:"id"`
+	}{jobID})
+}
+
+// eventsHandler streams job lifecycle events as Server-Sent Events
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Browsers send Last-Event-ID when reconnecting; the query parameter lets
+	// clients resume a stream they opened themselves
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	var lastID uint64
+	if lastEventID != "" {
+		id, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		lastID = id
+	}
+
+	replay, ch := events.subscribe(lastID)
+	defer events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	for _, e := range replay {
+		if err := writeEvent(w, e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case e, open := <-ch:
+			if !open {
+				// Fell too far behind; the client reconnects and replays
+				return
+			}
+			if err := writeEvent(w, e); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeEvent writes one event in the text/event-stream format
+func writeEvent(w http.ResponseWriter, e event) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, e.Data)
+	return err
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/superlive/shared/safepath"
+)
+
+// Error codes recorded on failed jobs
+const (
+	errorCorruptInput     = "corrupt_input"     // the source cannot be read or decoded
+	errorUnsupportedCodec = "unsupported_codec" // a decoder or encoder is not available
+	errorDiskFull         = "disk_full"         // no space left for the outputs
+	errorKilled           = "killed"            // ffmpeg was killed, e.g. by the OOM killer
+	errorTimeout          = "timeout"           // the job exceeded JOB_TIMEOUT
+	errorEncoder          = "encoder_error"     // ffmpeg failed for another reason
+	errorInternal         = "internal"          // anything else
+)
+
+var errorCodes = []string{
+	errorCorruptInput,
+	errorUnsupportedCodec,
+	errorDiskFull,
+	errorKilled,
+	errorTimeout,
+	errorEncoder,
+	errorInternal,
+}
+
+// Settings for retrying failed jobs automatically
+var (
+	// Processing attempts per job, including the first; 1 disables automatic retries
+	autoRetryAttempts = getEnvInt("AUTO_RETRY_ATTEMPTS", 3)
+
+	// Wait before the first automatic retry, doubling after every further failure
+	autoRetryBackoff = getEnvDuration("AUTO_RETRY_BACKOFF", 30*time.Second)
+
+	// Error codes worth retrying; the others fail the same way every time
+	autoRetryCodes []string
+)
+
+// Name of the ffmpeg log kept next to a job's renditions
+const ffmpegLogName = "ffmpeg.log"
+
+// jobError is a job failure with its error code
+type jobError struct {
+	Code    string
+	Message string
+	Err     error
+}
+
+func (e *jobError) Error() string {
+	return e.Message
+}
+
+func (e *jobError) Unwrap() error {
+	return e.Err
+}
+
+// Patterns in ffmpeg and ffprobe output that identify a failure, in the order
+// they are checked; disk errors often cause decoding errors too
+var failurePatterns = []struct {
+	code     string
+	patterns []string
+}{
+	{errorDiskFull, []string{
+		"no space left on device",
+		"disk quota exceeded",
+	}},
+	{errorUnsupportedCodec, []string{
+		"decoder not found",
+		"encoder not found",
+		"unknown encoder",
+		"unknown decoder",
+		") not found for input stream",
+		"codec not currently supported",
+		"unsupported codec",
+	}},
+	{errorCorruptInput, []string{
+		"invalid data found when processing input",
+		"moov atom not found",
+		"could not find codec parameters",
+		"error while decoding",
+		"invalid nal unit",
+		"header missing",
+		"end of file",
+	}},
+}
+
+// parseAutoRetryCodes parses the comma-separated AUTO_RETRY_CODES setting
+func parseAutoRetryCodes(spec string) ([]string, error) {
+	var codes []string
+	for _, code := range strings.Split(spec, ",") {
+		code = strings.TrimSpace(code)
+		if code == "" {
+			continue
+		}
+		if !containsString(errorCodes, code) {
+			return nil, fmt.Errorf("unknown error code %q, expected one of: %s", code, strings.Join(errorCodes, ", "))
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// toolFailure describes a failed ffmpeg or ffprobe run, classified from its
+// diagnostic output. The message holds the most telling line of the output
+// rather than all of it; the full output goes to the job's log.
+func toolFailure(desc string, err error, output []byte) error {
+	code, line := classifyOutput(err, output)
+
+	message := fmt.Sprintf("%s: %v", desc, err)
+	if line != "" {
+		message += ": " + line
+	}
+	return &jobError{Code: code, Message: message, Err: err}
+}
+
+// classifyOutput returns the error code for a failed ffmpeg or ffprobe run and
+// the output line that explains it best
+func classifyOutput(err error, output []byte) (string, string) {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+
+	for _, class := range failurePatterns {
+		for _, line := range lines {
+			lower := strings.ToLower(line)
+			for _, pattern := range class.patterns {
+				if strings.Contains(lower, pattern) {
+					return class.code, summarizeLine(line)
+				}
+			}
+		}
+	}
+
+	// Killed by a signal; cancellations and timeouts are told apart by the caller
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return errorKilled, ""
+		}
+	}
+
+	// Fall back to the last line, skipping ffmpeg's generic closing message
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := strings.TrimSpace(lines[i])
+		if line != "" && line != "Conversion failed!" {
+			return errorEncoder, summarizeLine(line)
+		}
+	}
+	return errorEncoder, ""
+}
+
+// summarizeLine trims an output line to a length that fits an error message
+func summarizeLine(line string) string {
+	const maxLen = 300
+
+	line = strings.TrimSpace(line)
+	if len(line) > maxLen {
+		line = line[:maxLen] + "..."
+	}
+	return line
+}
+
+// classifyFailure returns the error code for the error a job failed with
+func classifyFailure(err error) string {
+	var jobErr *jobError
+	if errors.As(err, &jobErr) {
+		return jobErr.Code
+	}
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) {
+		return errorDiskFull
+	}
+	return errorInternal
+}
+
+// shouldAutoRetry reports whether a job that failed with code after the given
+// number of attempts is retried automatically
+func shouldAutoRetry(code string, attempts int) bool {
+	return attempts < autoRetryAttempts && containsString(autoRetryCodes, code)
+}
+
+// autoRetryDelay returns how long to wait before the next attempt of a job
+// that failed after the given number of attempts
+func autoRetryDelay(attempts int) time.Duration {
+	delay := autoRetryBackoff
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+	}
+	return delay
+}
+
+// requeueJob puts a job waiting for an automatic retry back into the queue,
+// unless it has been cancelled, deleted, suspended or retried by hand in the
+// meantime; resuming a suspended job queues it
+func requeueJob(jobID string) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	job, exists := activeJobs[jobID]
+	if !exists || job.Status != "pending" || job.NextRetryAt == nil || job.Suspended {
+		return
+	}
+
+	// The job was accepted before, so it is queued even if the queue is full
+	job.NextRetryAt = nil
+	activeJobs[jobID] = job
+	saveJob(job)
+	pendingJobs.push(job)
+
+	log.Printf("Job %s queued for attempt %d", jobID, job.Attempts+1)
+}
+
+// appendJobLog adds the output of an ffmpeg or ffprobe run to a job's log
+func appendJobLog(outputDir, desc string, args []string, output []byte) {
+	f, err := os.OpenFile(filepath.Join(outputDir, ffmpegLogName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("Warning: Could not write ffmpeg log: %v", err)
+		return
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, "=== %s: %s ===\n", time.Now().UTC().Format(time.RFC3339), desc)
+	if len(args) > 0 {
+		fmt.Fprintf(f, "$ ffmpeg %s\n", strings.Join(args, " "))
+	}
+	f.Write(output)
+	if len(output) > 0 && output[len(output)-1] != '\n' {
+		f.Write([]byte("\n"))
+	}
+	f.Write([]byte("\n"))
+}
+
+// jobLogURL returns the URL of a job's ffmpeg log, or "" if it has none
+func jobLogURL(jobID string) string {
+	if _, err := os.Stat(filepath.Join(encodedDir, jobID, ffmpegLogName)); err != nil {
+		return ""
+	}
+	return fmt.Sprintf("/jobs/%s/log", jobID)
+}
+
+// jobLogHandler serves the ffmpeg log of a job as plain text
+func jobLogHandler(w http.ResponseWriter, r *http.Request, jobID string) {
+	jobsMutex.RLock()
+	exists := jobExists(jobID)
+	jobsMutex.RUnlock()
+	if !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	logPath, err := safepath.Resolve(encodedDir, filepath.Join(jobID, ffmpegLogName))
+	if err == safepath.ErrUnsafe {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+	if info, statErr := os.Stat(logPath); err != nil || statErr != nil || !info.Mode().IsRegular() {
+		http.Error(w, "Log not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	http.ServeFile(w, r, logPath)
+}
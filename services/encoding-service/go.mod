@@ -1,3 +1,7 @@
 module github.com/superlive/encoding-service
 
 go 1.19
+
+require github.com/superlive/shared v0.0.0
+
+replace github.com/superlive/shared => ../shared
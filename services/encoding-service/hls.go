@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// HLSMasterPlaylist is an HLS multivariant (master) playlist
+type HLSMasterPlaylist struct {
+	Version             int
+	IndependentSegments bool
+	Media               []HLSMedia
+	Variants            []HLSVariant
+}
+
+// HLSMedia is an #EXT-X-MEDIA rendition, such as the demuxed audio track
+type HLSMedia struct {
+	Type       string // AUDIO, SUBTITLES, ...
+	GroupID    string
+	Name       string
+	Language   string
+	Default    bool
+	AutoSelect bool
+	Channels   int
+	URI        string
+}
+
+// HLSVariant is an #EXT-X-STREAM-INF variant stream
+type HLSVariant struct {
+	Bandwidth        int64 // peak bits/s, including the audio group
+	AverageBandwidth int64
+	Codecs           []string // RFC 6381 codecs of the video and its audio group
+	Width            int
+	Height           int
+	FrameRate        float64
+	Audio            string // GROUP-ID of the audio renditions
+	URI              string
+}
+
+// Group ID of the demuxed audio rendition in master playlists
+const hlsAudioGroup = "audio"
+
+// buildHLSMaster assembles the master playlist for a job's CMAF renditions.
+// Codecs, bandwidths and frame rate are taken from the encoded renditions, as
+// for the DASH manifest.
+func buildHLSMaster(jobID, renditionsDir string, source *mediaProbe, resVariants []Resolution, hasAudio bool, profile EncodingProfile) *HLSMasterPlaylist {
+	duration := source.duration()
+
+	// fMP4 segments require playlist version 7
+	master := &HLSMasterPlaylist{
+		Version:             7,
+		IndependentSegments: true,
+	}
+
+	var audioCodec string
+	var audioPeak, audioAverage int64
+	if hasAudio {
+		dir := filepath.Join(renditionsDir, "audio")
+		media := HLSMedia{
+			Type:       "AUDIO",
+			GroupID:    hlsAudioGroup,
+			Name:       "Default",
+			Default:    true,
+			AutoSelect: true,
+			Channels:   profile.AudioChannels,
+			URI:        renditionURL(jobID, "audio") + "/playlist.m3u8",
+		}
+		if sourceAudio := source.audioStream(); sourceAudio != nil {
+			if lang := sourceAudio.language(); lang != "" {
+				media.Language = lang
+				media.Name = lang
+			}
+		}
+
+		audioCodec = "mp4a.40.2"
+		if probe, err := probeMedia(filepath.Join(dir, "init.mp4")); err != nil {
+			log.Printf("Warning: Could not probe audio rendition, using defaults: %v", err)
+		} else if stream := probe.audioStream(); stream != nil {
+			audioCodec = stream.codecString()
+			if stream.Channels > 0 {
+				media.Channels = stream.Channels
+			}
+		}
+
+		audioAverage, audioPeak = measureRendition(dir, duration, profile.SegmentSeconds)
+		if audioPeak == 0 {
+			audioAverage = bitrateToBps(profile.AudioBitrate)
+			audioPeak = audioAverage
+		}
+
+		master.Media = append(master.Media, media)
+	}
+
+	var frameRate float64
+	if sourceVideo := source.videoStream(); sourceVideo != nil {
+		frameRate = sourceVideo.frameRateValue()
+	}
+
+	for _, res := range resVariants {
+		name := renditionName(res)
+		dir := filepath.Join(renditionsDir, name)
+
+		variant := HLSVariant{
+			Codecs:    []string{profile.fallbackCodecString()},
+			Width:     res.Width,
+			Height:    res.Height,
+			FrameRate: frameRate,
+			URI:       renditionURL(jobID, name) + "/playlist.m3u8",
+		}
+
+		// The init segment carries the real codec parameters chosen by the encoder
+		if probe, err := probeMedia(filepath.Join(dir, "init.mp4")); err != nil {
+			log.Printf("Warning: Could not probe %s rendition, using defaults: %v", name, err)
+		} else if stream := probe.videoStream(); stream != nil {
+			variant.Codecs = []string{stream.codecString()}
+			variant.Width = stream.Width
+			variant.Height = stream.Height
+			if rate := stream.frameRateValue(); rate > 0 {
+				variant.FrameRate = rate
+			}
+		}
+
+		variant.AverageBandwidth, variant.Bandwidth = measureRendition(dir, duration, profile.SegmentSeconds)
+		if variant.Bandwidth == 0 {
+			variant.Bandwidth = bitrateToBps(res.Bitrate)
+			variant.AverageBandwidth = variant.Bandwidth
+		}
+
+		// Every variant plays together with the audio group
+		if hasAudio {
+			variant.Codecs = append(variant.Codecs, audioCodec)
+			variant.Bandwidth += audioPeak
+			variant.AverageBandwidth += audioAverage
+			variant.Audio = hlsAudioGroup
+		}
+
+		master.Variants = append(master.Variants, variant)
+	}
+
+	return master
+}
+
+// validate checks that the playlist references only renditions that exist
+// under renditionsDir, so a master is never published for a failed encode
+func (m *HLSMasterPlaylist) validate(renditionsDir string) error {
+	if len(m.Variants) == 0 {
+		return fmt.Errorf("master playlist has no variants")
+	}
+
+	var uris []string
+	for _, media := range m.Media {
+		uris = append(uris, media.URI)
+	}
+	for _, variant := range m.Variants {
+		if variant.Bandwidth <= 0 {
+			return fmt.Errorf("variant %s has no bandwidth", variant.URI)
+		}
+		uris = append(uris, variant.URI)
+	}
+
+	for _, uri := range uris {
+		// URIs are relative to the HLS directory; the last two elements name the playlist
+		rendition := filepath.Base(filepath.Dir(uri))
+		if _, err := os.Stat(filepath.Join(renditionsDir, rendition, "playlist.m3u8")); err != nil {
+			return fmt.Errorf("missing media playlist for %s: %w", rendition, err)
+		}
+	}
+	return nil
+}
+
+// String renders the playlist in the m3u8 format
+func (m *HLSMasterPlaylist) String() string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#EXT-X-VERSION:%d\n", m.Version)
+	if m.IndependentSegments {
+		b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	}
+
+	for _, media := range m.Media {
+		attrs := []string{
+			"TYPE=" + media.Type,
+			"GROUP-ID=" + quoteAttr(media.GroupID),
+			"NAME=" + quoteAttr(media.Name),
+		}
+		if media.Language != "" {
+			attrs = append(attrs, "LANGUAGE="+quoteAttr(media.Language))
+		}
+		attrs = append(attrs, "DEFAULT="+yesNo(media.Default), "AUTOSELECT="+yesNo(media.AutoSelect))
+		if media.Channels > 0 {
+			attrs = append(attrs, "CHANNELS="+quoteAttr(strconv.Itoa(media.Channels)))
+		}
+		attrs = append(attrs, "URI="+quoteAttr(media.URI))
+		fmt.Fprintf(&b, "#EXT-X-MEDIA:%s\n", strings.Join(attrs, ","))
+	}
+
+	for _, variant := range m.Variants {
+		attrs := []string{"BANDWIDTH=" + strconv.FormatInt(variant.Bandwidth, 10)}
+		if variant.AverageBandwidth > 0 {
+			attrs = append(attrs, "AVERAGE-BANDWIDTH="+strconv.FormatInt(variant.AverageBandwidth, 10))
+		}
+		if len(variant.Codecs) > 0 {
+			attrs = append(attrs, "CODECS="+quoteAttr(strings.Join(variant.Codecs, ",")))
+		}
+		if variant.Width > 0 && variant.Height > 0 {
+			attrs = append(attrs, fmt.Sprintf("RESOLUTION=%dx%d", variant.Width, variant.Height))
+		}
+		if variant.FrameRate > 0 {
+			attrs = append(attrs, "FRAME-RATE="+strconv.FormatFloat(variant.FrameRate, 'f', 3, 64))
+		}
+		if variant.Audio != "" {
+			attrs = append(attrs, "AUDIO="+quoteAttr(variant.Audio))
+		}
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:%s\n%s\n", strings.Join(attrs, ","), variant.URI)
+	}
+
+	return b.String()
+}
+
+// writeHLSMaster validates the playlist and writes it to path atomically, so
+// players never load a partially written master
+func writeHLSMaster(master *HLSMasterPlaylist, renditionsDir, path string) error {
+	if err := master.validate(renditionsDir); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, []byte(master.String())); err != nil {
+		return fmt.Errorf("failed to write master playlist: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place once it is complete
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// quoteAttr formats an m3u8 quoted-string attribute value. Quotes and line
+// breaks are not allowed inside, so they are dropped.
+func quoteAttr(value string) string {
+	value = strings.NewReplacer(`"`, "", "\n", "", "\r", "").Replace(value)
+	return `"` + value + `"`
+}
+
+// yesNo formats an m3u8 enumerated YES/NO attribute value
+func yesNo(value bool) string {
+	if value {
+		return "YES"
+	}
+	return "NO"
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Limits on the resources a single job may use, so one huge file cannot starve the host
+var (
+	// Threads each ffmpeg process may use for decoding and encoding; 0 lets ffmpeg decide
+	ffmpegThreads = getEnvInt("FFMPEG_THREADS", 0)
+
+	// Niceness ffmpeg runs with, from 1 (slightly lower priority) to 19 (lowest); 0 leaves it
+	// unchanged. It is read from FFMPEG_NICE by checkResourceLimits.
+	ffmpegNice int
+
+	// cgroup v2 directory, e.g. /sys/fs/cgroup/encoding, that ffmpeg processes are
+	// moved into so its cpu.max and memory.max limits apply to them
+	ffmpegCgroup = getEnv("FFMPEG_CGROUP", "")
+
+	// Longest a job may run before it is stopped and marked failed; 0 means no limit
+	jobTimeout = getEnvDuration("JOB_TIMEOUT", 0)
+)
+
+// checkResourceLimits validates the configured limits at startup
+func checkResourceLimits() error {
+	// Parsed here rather than with getEnvInt, which would turn a negative value into 0
+	if value := getEnv("FFMPEG_NICE", ""); value != "" {
+		nice, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || nice < 0 || nice > 19 {
+			return fmt.Errorf("FFMPEG_NICE must be a whole number between 0 and 19, got %q", value)
+		}
+		ffmpegNice = nice
+	}
+	if ffmpegCgroup != "" {
+		if _, err := os.Stat(filepath.Join(ffmpegCgroup, "cgroup.procs")); err != nil {
+			return fmt.Errorf("FFMPEG_CGROUP is not a cgroup directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// jobContext returns the context a job is processed under, which is cancelled
+// when the job is cancelled or exceeds jobTimeout
+func jobContext() (context.Context, context.CancelFunc) {
+	if jobTimeout > 0 {
+		return context.WithTimeout(context.Background(), jobTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// ffmpegCommand returns an ffmpeg command with the configured niceness and
+// decoder thread limit. The process is killed when ctx is cancelled.
+func ffmpegCommand(ctx context.Context, args ...string) *exec.Cmd {
+	args = append(threadArgs(), args...)
+	if ffmpegNice > 0 {
+		// nice execs ffmpeg, so every thread it starts inherits the niceness
+		return exec.CommandContext(ctx, "nice", append([]string{"-n", strconv.Itoa(ffmpegNice), "ffmpeg"}, args...)...)
+	}
+	return exec.CommandContext(ctx, "ffmpeg", args...)
+}
+
+// threadArgs returns the ffmpeg -threads option, if a limit is configured. It
+// applies to the decoder before -i and to the encoder among the output options.
+func threadArgs() []string {
+	if ffmpegThreads <= 0 {
+		return nil
+	}
+	return []string{"-threads", strconv.Itoa(ffmpegThreads)}
+}
+
+// startLimited starts an ffmpeg command and moves it into the configured cgroup
+func startLimited(cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	if ffmpegCgroup != "" {
+		procs := filepath.Join(ffmpegCgroup, "cgroup.procs")
+		if err := os.WriteFile(procs, []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+			log.Printf("Warning: Could not move ffmpeg (pid %d) into cgroup %s: %v", cmd.Process.Pid, ffmpegCgroup, err)
+		}
+	}
+	return nil
+}
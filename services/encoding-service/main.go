@@ -1,19 +1,24 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/fs"
 	"log"
 	"math"
+	"mime"
 	"net/http"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/superlive/shared/safepath"
 )
 
 const (
@@ -23,31 +28,54 @@ const (
 	dashDir    = "./encoded/dash" // MPEG-DASH output
 	hlsDir     = "./encoded/hls"  // HLS output
 
-	// Default encoding resolutions
-	resolutions = "426:240,640:360,854:480,1280:720,1920:1080"
+	// Job journal location, outside the encoded directory because that is served publicly
+	defaultJobStorePath = "./data/jobs.journal"
 
-	// Queue settings
-	maxConcurrentJobs = 2
+	// Encoding profiles config file
+	defaultProfilesPath = "./profiles.json"
 )
 
-// Resolution represents a video resolution
+// Resolution represents a video resolution and its target bitrate
 type Resolution struct {
-	Width  int
-	Height int
+	Width   int
+	Height  int
+	Bitrate string // ffmpeg bitrate, e.g. "2500k"
 }
 
 // EncodingJob represents a video encoding job
 type EncodingJob struct {
 	ID           string    `json:"id"`
 	SourceFile   string    `json:"source_file"`
-	Status       string    `json:"status"` // pending, processing, completed, failed
+	Profile      string    `json:"profile,omitempty"`
+	Owner        string    `json:"owner,omitempty"` // scheduling is fair between owners
+	Priority     int       `json:"priority"`        // higher runs first
+	Status       string    `json:"status"`          // pending, processing, completed, failed
 	Progress     int       `json:"progress"`
 	ErrorMessage string    `json:"error_message,omitempty"`
+	ErrorCode    string    `json:"error_code,omitempty"` // classifies ErrorMessage, e.g. corrupt_input
 	CreatedAt    time.Time `json:"created_at"`
 	StartedAt    time.Time `json:"started_at,omitempty"`
 	CompletedAt  time.Time `json:"completed_at,omitempty"`
 	DashManifest string    `json:"dash_manifest,omitempty"`
 	HlsManifest  string    `json:"hls_manifest,omitempty"`
+	Thumbnail    string    `json:"thumbnail,omitempty"`
+	Duration     float64   `json:"duration,omitempty"` // source duration in seconds
+	LogURL       string    `json:"log_url,omitempty"`  // ffmpeg output of every attempt
+
+	// Processing attempts so far, and when a failed job is retried automatically
+	Attempts    int        `json:"attempts,omitempty"`
+	NextRetryAt *time.Time `json:"next_retry_at,omitempty"`
+
+	// Set while the source file is in the catalog's trash; suspended jobs are
+	// not processed, listed as streams or served until they are resumed
+	Suspended bool `json:"suspended,omitempty"`
+
+	// Live progress details while the job is processing
+	CurrentRendition string `json:"current_rendition,omitempty"`
+	ETASeconds       int    `json:"eta_seconds,omitempty"`
+
+	// 1-based place in the queue while the job is pending; filled in when the job is returned
+	QueuePosition int `json:"queue_position,omitempty"`
 }
 
 // Stream represents a video stream ready for playback
@@ -64,29 +92,85 @@ type Stream struct {
 
 // Global variables
 var (
-	// In-memory job queue
-	jobQueue      = make(chan EncodingJob, 100)
+	// Jobs by state; pending jobs also wait in pendingJobs
 	activeJobs    = make(map[string]EncodingJob)
 	completedJobs = make(map[string]EncodingJob)
 	failedJobs    = make(map[string]EncodingJob)
 	jobsMutex     = &sync.RWMutex{}
+
+	// Cancel functions for jobs currently being processed, guarded by jobsMutex
+	runningJobs = make(map[string]context.CancelFunc)
+
+	// Durable record of every job, mirrored by the maps above
+	jobStore JobStore
 )
 
 func main() {
 	// Create required directories
 	createDirectories()
 
+	// Load named encoding profiles
+	profiles, err := loadProfiles(getEnv("ENCODING_PROFILES_PATH", defaultProfilesPath))
+	if err != nil {
+		log.Fatalf("Failed to load encoding profiles: %v", err)
+	}
+	encodingProfiles = profiles
+
+	// Default job priorities by source directory
+	priorities, err := parseDirectoryPriorities(getEnv("DIRECTORY_PRIORITIES", ""))
+	if err != nil {
+		log.Fatalf("Failed to parse DIRECTORY_PRIORITIES: %v", err)
+	}
+	directoryPriorities = priorities
+
+	// Open the persistent job store
+	store, err := openJournalStore(getEnv("JOB_STORE_PATH", defaultJobStorePath))
+	if err != nil {
+		log.Fatalf("Failed to open job store: %v", err)
+	}
+	defer store.Close()
+	jobStore = store
+
+	if err := webhooks.load(webhooksPath); err != nil {
+		log.Fatalf("Failed to load webhooks: %v", err)
+	}
+	if err := webhooks.loadDeliveries(webhookDeliveriesPath); err != nil {
+		log.Fatalf("Failed to load webhook deliveries: %v", err)
+	}
+
+	codes, err := parseAutoRetryCodes(getEnv("AUTO_RETRY_CODES", "disk_full,killed"))
+	if err != nil {
+		log.Fatalf("Invalid AUTO_RETRY_CODES: %v", err)
+	}
+	autoRetryCodes = codes
+
+	if err := checkResourceLimits(); err != nil {
+		log.Fatalf("Invalid resource limits: %v", err)
+	}
+
 	// Start job processor workers
-	for i := 0; i < maxConcurrentJobs; i++ {
-		go worker()
+	if initialWorkers < 1 || initialWorkers > maxWorkers {
+		log.Fatalf("MAX_CONCURRENT_JOBS must be between 1 and %d", maxWorkers)
 	}
+	pool.resize(initialWorkers)
+
+	// Reload jobs from previous runs and resume interrupted ones
+	restoreJobs()
 
 	// Set up HTTP server with CORS middleware
 	mux := http.NewServeMux()
 	mux.HandleFunc("/encode", submitJobHandler)
-	mux.HandleFunc("/jobs", listJobsHandler)
-	mux.HandleFunc("/jobs/", getJobHandler)
+	mux.HandleFunc("/jobs", jobsHandler)
+	mux.HandleFunc("/jobs/", jobHandler)
+	mux.HandleFunc("/jobs/suspend", suspendSourceJobsHandler)
+	mux.HandleFunc("/jobs/resume", resumeSourceJobsHandler)
+	mux.HandleFunc("/queue", queueHandler)
+	mux.HandleFunc("/workers", workersHandler)
+	mux.HandleFunc("/events", eventsHandler)
+	mux.HandleFunc("/webhooks", webhooksHandler)
+	mux.HandleFunc("/webhooks/", webhookHandler)
 	mux.HandleFunc("/streams", listStreamsHandler)
+	mux.HandleFunc("/profiles", listProfilesHandler)
 	mux.HandleFunc("/health", healthCheckHandler)
 
 	// Add a specific handler for thumbnail files
@@ -97,9 +181,11 @@ func main() {
 		// Get the first job ID from the completed jobs
 		var jobID string
 		jobsMutex.RLock()
-		for id := range completedJobs {
-			jobID = id
-			break
+		for id, job := range completedJobs {
+			if !job.Suspended {
+				jobID = id
+				break
+			}
 		}
 		jobsMutex.RUnlock()
 
@@ -124,21 +210,34 @@ func main() {
 		http.ServeFile(w, r, thumbnailPath)
 	})
 
-	// Serve encoded files
-	mux.Handle("/dash/", http.StripPrefix("/dash/", http.FileServer(http.Dir(dashDir))))
-	mux.Handle("/hls/", http.StripPrefix("/hls/", http.FileServer(http.Dir(hlsDir))))
-	mux.Handle("/encoded/", http.StripPrefix("/encoded/", logFileServer(http.Dir(encodedDir))))
+	// Register streaming MIME types so players get correct Content-Type headers
+	mime.AddExtensionType(".mpd", "application/dash+xml")
+	mime.AddExtensionType(".m3u8", "application/vnd.apple.mpegurl")
+	mime.AddExtensionType(".m4s", "video/iso.segment")
+
+	// Serve encoded files, except those of suspended jobs
+	mux.Handle("/dash/", http.StripPrefix("/dash/", hideSuspendedOutputs(http.FileServer(http.Dir(dashDir)))))
+	mux.Handle("/hls/", http.StripPrefix("/hls/", hideSuspendedOutputs(http.FileServer(http.Dir(hlsDir)))))
+	mux.Handle("/encoded/", http.StripPrefix("/encoded/", encodedOutputsOnly(logFileServer(http.Dir(encodedDir)))))
 
 	// Add a debug endpoint for thumbnails
 	mux.HandleFunc("/debug/thumbnail/", func(w http.ResponseWriter, r *http.Request) {
 		path := strings.TrimPrefix(r.URL.Path, "/debug/thumbnail/")
-		fullPath := filepath.Join(encodedDir, path)
+		fullPath, err := safepath.Resolve(encodedDir, path)
+		if err == safepath.ErrUnsafe {
+			http.Error(w, "Invalid thumbnail path", http.StatusBadRequest)
+			return
+		}
+		if jobID, name, _ := strings.Cut(path, "/"); name != "thumbnail.jpg" || jobSuspended(jobID) {
+			http.Error(w, "Thumbnail not found", http.StatusNotFound)
+			return
+		}
 
 		log.Printf("Debug thumbnail request for: %s (full path: %s)", path, fullPath)
 
-		// Check if file exists
-		if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-			log.Printf("Thumbnail file not found: %s", fullPath)
+		// Check if file exists; directories are not listed
+		if info, statErr := os.Stat(fullPath); err != nil || statErr != nil || !info.Mode().IsRegular() {
+			log.Printf("Thumbnail file not found: %s", path)
 			http.Error(w, "Thumbnail not found", http.StatusNotFound)
 			return
 		}
@@ -184,7 +283,7 @@ func corsMiddleware(next http.Handler) http.Handler {
 			w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
 		}
 
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding")
 
 		// Handle preflight OPTIONS request
@@ -217,6 +316,51 @@ func logFileServer(root http.FileSystem) http.Handler {
 	})
 }
 
+// Playback output below encodedDir, relative to it; jobElem is the path element
+// holding the job ID. Everything else there, such as ffmpeg logs, is not served.
+var encodedOutputs = []struct {
+	pattern string
+	jobElem int
+}{
+	{"dash/*/manifest.mpd", 1},
+	{"hls/*/master.m3u8", 1},
+	{"*/thumbnail.jpg", 0},
+	{"*/*/init.mp4", 0},
+	{"*/*/playlist.m3u8", 0},
+	{"*/*/seg_*.m4s", 0},
+}
+
+// encodedOutputsOnly serves the playback output below encodedDir, answering
+// 404 for any other file and for the outputs of suspended jobs
+func encodedOutputsOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Clean the path as the file server does before matching it
+		jobID, ok := encodedOutputJob(strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/"))
+		if !ok || jobSuspended(jobID) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// encodedOutputJob reports whether a path relative to encodedDir is playback
+// output, and which job it belongs to
+func encodedOutputJob(name string) (string, bool) {
+	elems := strings.Split(name, "/")
+	for _, elem := range elems {
+		if strings.HasPrefix(elem, ".") {
+			return "", false
+		}
+	}
+	for _, output := range encodedOutputs {
+		if matched, _ := path.Match(output.pattern, name); matched {
+			return elems[output.jobElem], true
+		}
+	}
+	return "", false
+}
+
 // createDirectories creates all necessary directories
 func createDirectories() {
 	dirs := []string{
@@ -233,341 +377,455 @@ func createDirectories() {
 	}
 }
 
-// worker processes jobs from the queue
-func worker() {
-	for job := range jobQueue {
-		// Update job status to processing
-		job.Status = "processing"
-		job.StartedAt = time.Now()
-		updateJob(job)
-
-		log.Printf("Processing job %s: %s", job.ID, job.SourceFile)
+// restoreJobs loads persisted jobs into memory and re-enqueues unfinished ones
+func restoreJobs() {
+	jobs, err := jobStore.Load()
+	if err != nil {
+		log.Printf("Error loading jobs from store: %v", err)
+		return
+	}
 
-		// Process the video
-		err := processVideo(job)
+	var resumed, waiting []EncodingJob
 
-		jobsMutex.Lock()
-		if err != nil {
-			job.Status = "failed"
-			job.ErrorMessage = err.Error()
-			failedJobs[job.ID] = job
-			delete(activeJobs, job.ID)
-			log.Printf("Job %s failed: %v", job.ID, err)
-		} else {
-			job.Status = "completed"
-			job.Progress = 100
-			job.CompletedAt = time.Now()
-			job.DashManifest = fmt.Sprintf("/dash/%s/manifest.mpd", job.ID)
-			job.HlsManifest = fmt.Sprintf("/hls/%s/master.m3u8", job.ID)
+	jobsMutex.Lock()
+	for _, job := range jobs {
+		switch job.Status {
+		case "completed":
 			completedJobs[job.ID] = job
-			delete(activeJobs, job.ID)
-			log.Printf("Job %s completed successfully", job.ID)
+		case "failed", "cancelled":
+			failedJobs[job.ID] = job
+		default:
+			// Jobs that were pending or processing when the process died start
+			// over, unless they are suspended; jobs waiting for an automatic
+			// retry keep waiting until it is due
+			job.Status = "pending"
+			job.Progress = 0
+			job.StartedAt = time.Time{}
+			activeJobs[job.ID] = job
+			switch {
+			case job.Suspended:
+			case job.NextRetryAt != nil:
+				waiting = append(waiting, job)
+			default:
+				resumed = append(resumed, job)
+			}
 		}
-		jobsMutex.Unlock()
 	}
-}
+	jobsMutex.Unlock()
 
-// processVideo processes a video file using ffmpeg
-func processVideo(job EncodingJob) error {
-	sourceFilePath := filepath.Join(mediaDir, job.SourceFile)
-	outputBasePath := filepath.Join(encodedDir, job.ID)
-	dashOutputPath := filepath.Join(dashDir, job.ID)
-	hlsOutputPath := filepath.Join(hlsDir, job.ID)
+	log.Printf("Restored %d jobs from store (%d resumed, %d waiting to retry)", len(jobs), len(resumed), len(waiting))
 
-	// Create output directories
-	if err := os.MkdirAll(dashOutputPath, 0755); err != nil {
-		return fmt.Errorf("failed to create DASH output directory: %w", err)
+	for _, job := range resumed {
+		saveJob(job)
+		pendingJobs.push(job)
 	}
-
-	if err := os.MkdirAll(hlsOutputPath, 0755); err != nil {
-		return fmt.Errorf("failed to create HLS output directory: %w", err)
+	for _, job := range waiting {
+		saveJob(job)
+		jobID := job.ID
+		// A retry that fell due while the service was down is queued right away
+		time.AfterFunc(time.Until(*job.NextRetryAt), func() { requeueJob(jobID) })
 	}
+}
 
-	// Get video dimensions to maintain aspect ratio
-	width, height, err := getVideoDimensions(sourceFilePath)
-	if err != nil {
-		return fmt.Errorf("failed to get video dimensions: %w", err)
+// runJob processes a job taken from the queue and records its outcome
+func runJob(jobID string) {
+	job, ctx, ok := startJob(jobID)
+	if !ok {
+		// Cancelled, deleted or already picked up while waiting in the queue
+		log.Printf("Skipping job %s: no longer pending", jobID)
+		return
 	}
 
-	// Check if the video file has audio
-	hasAudio, err := checkForAudioStream(sourceFilePath)
-	if err != nil {
-		log.Printf("Warning: Could not determine if file has audio: %v", err)
-		// Continue with default behavior assuming it might have audio
-		hasAudio = true
+	log.Printf("Processing job %s: %s", job.ID, job.SourceFile)
+
+	// Process the video
+	err := processVideo(ctx, job)
+
+	jobsMutex.Lock()
+	// Read why the context ended before releasing it, which cancels it too
+	ctxErr := ctx.Err()
+	runningJobs[job.ID]()
+	delete(runningJobs, job.ID)
+
+	current, exists := activeJobs[job.ID]
+	if !exists {
+		// The job was deleted while running; discard anything written since
+		jobsMutex.Unlock()
+		removeJobOutputs(job.ID)
+		log.Printf("Job %s was deleted while processing", job.ID)
+		return
 	}
+	// Keep details recorded while processing, such as the source duration
+	job = current
 
-	// Create thumbnail
-	if err := createThumbnail(sourceFilePath, filepath.Join(outputBasePath, "thumbnail.jpg")); err != nil {
-		log.Printf("Warning: Failed to create thumbnail: %v", err)
-		// Continue processing, thumbnail is not critical
+	if ctxErr == context.DeadlineExceeded {
+		err = &jobError{Code: errorTimeout, Message: fmt.Sprintf("timed out after %s", jobTimeout), Err: ctxErr}
 	}
 
-	// Generate fragmented MP4 for DASH
-	if err := generateDASH(sourceFilePath, dashOutputPath, job.ID, hasAudio, width, height); err != nil {
-		return fmt.Errorf("DASH generation failed: %w", err)
+	if ctxErr == context.Canceled && job.Suspended {
+		// Stopped because the source went to the trash; it runs again once resumed
+		job.Status = "pending"
+		job.Progress = 0
+		job.StartedAt = time.Time{}
+		job.CurrentRendition = ""
+		job.ETASeconds = 0
+		activeJobs[job.ID] = job
+		saveJob(job)
+		publishJobEvent(eventJobSuspended, job)
+		log.Printf("Job %s suspended while processing", job.ID)
+	} else if ctxErr == context.Canceled {
+		job.Status = "cancelled"
+		job.ErrorMessage = "cancelled by request"
+		job.CurrentRendition = ""
+		job.ETASeconds = 0
+		failedJobs[job.ID] = job
+		delete(activeJobs, job.ID)
+		saveJob(job)
+		publishJobEvent(eventJobCancelled, job)
+		log.Printf("Job %s cancelled", job.ID)
+	} else if err != nil {
+		failJob(job, err)
+	} else {
+		job.Status = "completed"
+		job.Progress = 100
+		job.CurrentRendition = ""
+		job.ETASeconds = 0
+		job.CompletedAt = time.Now()
+		job.DashManifest = fmt.Sprintf("/dash/%s/manifest.mpd", job.ID)
+		job.HlsManifest = fmt.Sprintf("/hls/%s/master.m3u8", job.ID)
+		if _, err := os.Stat(filepath.Join(encodedDir, job.ID, "thumbnail.jpg")); err == nil {
+			job.Thumbnail = fmt.Sprintf("/encoded/%s/thumbnail.jpg", job.ID)
+		}
+		job.LogURL = jobLogURL(job.ID)
+		completedJobs[job.ID] = job
+		delete(activeJobs, job.ID)
+		saveJob(job)
+		publishJobEvent(eventJobCompleted, job)
+		events.publish(eventStreamPublished, newStream(job))
+		log.Printf("Job %s completed successfully", job.ID)
 	}
+	jobsMutex.Unlock()
+}
 
-	// Generate HLS
-	if err := generateHLS(sourceFilePath, hlsOutputPath, job.ID, hasAudio, width, height); err != nil {
-		return fmt.Errorf("HLS generation failed: %w", err)
+// failJob records a processing failure, scheduling an automatic retry if the
+// failure is transient and attempts are left. Callers must hold jobsMutex.
+func failJob(job EncodingJob, err error) {
+	job.ErrorCode = classifyFailure(err)
+	job.ErrorMessage = err.Error()
+	job.CurrentRendition = ""
+	job.ETASeconds = 0
+	job.LogURL = jobLogURL(job.ID)
+
+	if shouldAutoRetry(job.ErrorCode, job.Attempts) {
+		delay := autoRetryDelay(job.Attempts)
+		next := time.Now().Add(delay)
+		job.Status = "pending"
+		job.Progress = 0
+		job.NextRetryAt = &next
+		activeJobs[job.ID] = job
+		saveJob(job)
+		publishJobEvent(eventJobRetried, job)
+		time.AfterFunc(delay, func() { requeueJob(job.ID) })
+		log.Printf("Job %s failed (%s), retrying in %s: %v", job.ID, job.ErrorCode, delay, err)
+		return
 	}
 
-	return nil
+	job.Status = "failed"
+	failedJobs[job.ID] = job
+	delete(activeJobs, job.ID)
+	saveJob(job)
+	publishJobEvent(eventJobFailed, job)
+	log.Printf("Job %s failed (%s): %v", job.ID, job.ErrorCode, err)
 }
 
-// getVideoDimensions gets the width and height of the video file
-func getVideoDimensions(inputFile string) (int, int, error) {
-	cmd := exec.Command(
-		"ffprobe",
-		"-v", "error",
-		"-select_streams", "v:0",
-		"-show_entries", "stream=width,height",
-		"-of", "csv=s=x:p=0",
-		inputFile,
-	)
+// startJob marks a pending job as processing and registers its cancel function.
+// It returns false if the job is no longer waiting to be processed.
+func startJob(jobID string) (EncodingJob, context.Context, bool) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
 
-	output, err := cmd.Output()
-	if err != nil {
-		return 0, 0, err
+	job, exists := activeJobs[jobID]
+	if !exists || job.Status != "pending" || job.Suspended {
+		return EncodingJob{}, nil, false
 	}
 
-	// Parse the output which should be in format "width x height"
-	parts := strings.Split(strings.TrimSpace(string(output)), "x")
-	if len(parts) != 2 {
-		return 0, 0, fmt.Errorf("unexpected ffprobe output format: %s", string(output))
-	}
+	ctx, cancel := jobContext()
+	runningJobs[jobID] = cancel
 
-	width, err := strconv.Atoi(parts[0])
-	if err != nil {
-		return 0, 0, fmt.Errorf("invalid width value: %w", err)
-	}
+	// Update job status to processing
+	job.Status = "processing"
+	job.StartedAt = time.Now()
+	job.Attempts++
+	activeJobs[jobID] = job
+	saveJob(job)
+	publishJobEvent(eventJobStarted, job)
 
-	height, err := strconv.Atoi(parts[1])
-	if err != nil {
-		return 0, 0, fmt.Errorf("invalid height value: %w", err)
+	return job, ctx, true
+}
+
+// removeJobOutputs deletes every directory generated for a job
+func removeJobOutputs(jobID string) {
+	dirs := []string{
+		filepath.Join(encodedDir, jobID),
+		filepath.Join(dashDir, jobID),
+		filepath.Join(hlsDir, jobID),
 	}
 
-	return width, height, nil
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Error removing output directory %s: %v", dir, err)
+		}
+	}
 }
 
-// checkForAudioStream checks if the video file has audio streams
-func checkForAudioStream(inputFile string) (bool, error) {
-	cmd := exec.Command(
-		"ffprobe",
-		"-v", "error",
-		"-select_streams", "a:0",
-		"-show_entries", "stream=codec_type",
-		"-of", "csv=p=0",
-		inputFile,
-	)
+// clearJobOutputs deletes what an earlier attempt left behind for a job, so
+// stale segments are neither measured nor listed in the new manifests. The
+// ffmpeg log is kept, as it covers every attempt.
+func clearJobOutputs(jobID string) error {
+	for _, dir := range []string{filepath.Join(dashDir, jobID), filepath.Join(hlsDir, jobID)} {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
 
-	output, err := cmd.Output()
+	outputBasePath := filepath.Join(encodedDir, jobID)
+	entries, err := os.ReadDir(outputBasePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
-		return false, err
+		return err
 	}
-
-	// If there's output containing "audio", the file has an audio stream
-	return strings.Contains(string(output), "audio"), nil
+	for _, entry := range entries {
+		if entry.Name() == ffmpegLogName {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(outputBasePath, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// generateDASH generates MPEG-DASH files
-func generateDASH(inputFile, outputDir, jobID string, hasAudio bool, origWidth, origHeight int) error {
-	// Calculate scaled resolutions that maintain aspect ratio
-	resVariants := calculateResolutions(origWidth, origHeight)
+// processVideo processes a video file using ffmpeg. Every rendition is encoded
+// once into CMAF (fragmented MP4) segments under encoded/<job>, and both the DASH
+// manifest and the HLS playlists reference those same segment files.
+func processVideo(ctx context.Context, job EncodingJob) error {
+	sourceFilePath := filepath.Join(mediaDir, job.SourceFile)
+	outputBasePath := filepath.Join(encodedDir, job.ID)
+	dashOutputPath := filepath.Join(dashDir, job.ID)
+	hlsOutputPath := filepath.Join(hlsDir, job.ID)
 
-	// Create a separate DASH output for each resolution to avoid aspect ratio conflicts
-	for _, res := range resVariants {
-		variantName := fmt.Sprintf("%dp", res.Height)
-		variantDir := filepath.Join(outputDir, variantName)
+	profile, ok := getProfile(job.Profile)
+	if !ok {
+		return fmt.Errorf("unknown encoding profile %q", job.Profile)
+	}
 
-		if err := os.MkdirAll(variantDir, 0755); err != nil {
-			return fmt.Errorf("failed to create variant directory: %w", err)
-		}
+	// Start from empty output directories
+	if err := clearJobOutputs(job.ID); err != nil {
+		return fmt.Errorf("failed to clear previous outputs: %w", err)
+	}
 
-		args := []string{
-			"-i", inputFile,
-			"-c:v", "libx264",
-			"-preset", "medium",
-			"-keyint_min", "60",
-			"-g", "60",
-			"-sc_threshold", "0",
-			"-profile:v", "high",
-			"-vf", fmt.Sprintf("scale=%d:%d", res.Width, res.Height),
-			"-b:v", getBitrateForHeight(res.Height),
-		}
+	if err := os.MkdirAll(outputBasePath, 0755); err != nil {
+		return fmt.Errorf("failed to create rendition output directory: %w", err)
+	}
 
-		// Add audio only if available
-		if hasAudio {
-			args = append(args,
-				"-map", "0:v:0",
-				"-map", "0:a:0?", // The ? makes this mapping optional
-				"-c:a", "aac",
-				"-b:a", "128k",
-			)
-		} else {
-			args = append(args, "-map", "0:v:0")
-		}
+	if err := os.MkdirAll(dashOutputPath, 0755); err != nil {
+		return fmt.Errorf("failed to create DASH output directory: %w", err)
+	}
 
-		// Add output file (MP4 format)
-		args = append(args,
-			"-f", "mp4",
-			filepath.Join(variantDir, "stream.mp4"))
+	if err := os.MkdirAll(hlsOutputPath, 0755); err != nil {
+		return fmt.Errorf("failed to create HLS output directory: %w", err)
+	}
 
-		cmd := exec.Command("ffmpeg", args...)
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("ffmpeg encoding error for %dp: %w - %s", res.Height, err, string(output))
+	// Probe the source for dimensions, audio, duration and frame rate
+	source, err := probeMedia(sourceFilePath)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			appendJobLog(outputBasePath, "ffprobe "+job.SourceFile, nil, exitErr.Stderr)
+			return toolFailure("failed to probe source file", err, exitErr.Stderr)
 		}
+		return fmt.Errorf("failed to probe source file: %w", err)
+	}
+
+	video := source.videoStream()
+	if video == nil || video.Width == 0 || video.Height == 0 {
+		return &jobError{Code: errorCorruptInput, Message: "source file has no video stream with known dimensions"}
+	}
+	hasAudio := source.audioStream() != nil
+	duration := source.duration()
+	if duration <= 0 {
+		log.Printf("Warning: Could not determine video duration, progress will be coarse")
+	} else {
+		job.Duration = duration
+		updateJob(job)
 	}
 
-	// Generate a master DASH manifest file
-	manifestContent := `<?xml version="1.0" encoding="utf-8"?>
-<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" minBufferTime="PT1.5S" type="static" mediaPresentationDuration="PT0H3M0.0S" profiles="urn:mpeg:dash:profile:isoff-on-demand:2011">
-  <Period duration="PT0H3M0.0S">`
+	// Calculate scaled resolutions that maintain aspect ratio
+	resVariants := calculateResolutions(video.Width, video.Height, profile.Ladder)
 
-	// Add AdaptationSet for video
-	manifestContent += `
-    <AdaptationSet segmentAlignment="true" group="1" maxWidth="` + fmt.Sprintf("%d", origWidth) + `" maxHeight="` + fmt.Sprintf("%d", origHeight) + `" maxFrameRate="30" par="16:9">`
+	// One ffmpeg pass per video rendition plus one for the audio rendition
+	passes := len(resVariants)
+	if hasAudio {
+		passes++
+	}
+	progress := newProgressTracker(job, duration, passes)
 
-	// Add each video representation
-	for _, res := range resVariants {
-		variantName := fmt.Sprintf("%dp", res.Height)
-		manifestContent += `
-      <Representation id="` + variantName + `" mimeType="video/mp4" codecs="avc1.64001F" width="` + fmt.Sprintf("%d", res.Width) + `" height="` + fmt.Sprintf("%d", res.Height) + `" frameRate="30" sar="1:1" bandwidth="` + getBandwidthForHeight(res.Height) + `">
-        <BaseURL>` + variantName + `/stream.mp4</BaseURL>
-      </Representation>`
+	// Create thumbnail
+	if err := createThumbnail(ctx, sourceFilePath, filepath.Join(outputBasePath, "thumbnail.jpg")); err != nil {
+		log.Printf("Warning: Failed to create thumbnail: %v", err)
+		// Continue processing, thumbnail is not critical
 	}
 
-	manifestContent += `
-    </AdaptationSet>`
+	// Encode each video rendition exactly once
+	for i, res := range resVariants {
+		progress.startPass(i, renditionName(res))
+		if err := encodeVideoRendition(ctx, sourceFilePath, outputBasePath, res, profile, progress); err != nil {
+			return err
+		}
+	}
 
-	// Add AdaptationSet for audio if available
+	// Encode the audio track once, shared by every video rendition
 	if hasAudio {
-		manifestContent += `
-    <AdaptationSet segmentAlignment="true" group="2">
-      <Representation id="audio" mimeType="audio/mp4" codecs="mp4a.40.2" bandwidth="128000">
-        <BaseURL>240p/stream.mp4</BaseURL>
-      </Representation>
-    </AdaptationSet>`
+		progress.startPass(len(resVariants), "audio")
+		if err := encodeAudioRendition(ctx, sourceFilePath, outputBasePath, profile, progress); err != nil {
+			return err
+		}
 	}
 
-	manifestContent += `
-  </Period>
-</MPD>`
+	// Package the shared segments for DASH
+	if err := generateDASH(dashOutputPath, outputBasePath, job.ID, source, resVariants, hasAudio, profile); err != nil {
+		return fmt.Errorf("DASH generation failed: %w", err)
+	}
 
-	// Write the manifest file
-	manifestPath := filepath.Join(outputDir, "manifest.mpd")
-	if err := os.WriteFile(manifestPath, []byte(manifestContent), 0644); err != nil {
-		return fmt.Errorf("failed to write DASH manifest: %w", err)
+	// Package the shared segments for HLS
+	if err := generateHLS(hlsOutputPath, outputBasePath, job.ID, source, resVariants, hasAudio, profile); err != nil {
+		return fmt.Errorf("HLS generation failed: %w", err)
 	}
 
 	return nil
 }
 
-// generateHLS generates HLS files
-func generateHLS(inputFile, outputDir, jobID string, hasAudio bool, origWidth, origHeight int) error {
-	// Calculate scaled resolutions that maintain aspect ratio
-	resVariants := calculateResolutions(origWidth, origHeight)
+// renditionName returns the directory and representation name for a resolution
+func renditionName(res Resolution) string {
+	return fmt.Sprintf("%dp", res.Height)
+}
 
-	// Create master playlist
-	masterPlaylist := filepath.Join(outputDir, "master.m3u8")
+// renditionURL returns the URL of a rendition directory relative to a job's
+// /dash/<job>/ or /hls/<job>/ manifest location
+func renditionURL(jobID, rendition string) string {
+	return fmt.Sprintf("../../encoded/%s/%s", jobID, rendition)
+}
 
-	// Create variant streams
-	for i, res := range resVariants {
-		variantName := fmt.Sprintf("%dp", res.Height)
-		variantDir := filepath.Join(outputDir, variantName)
+// cmafSegmentArgs returns the ffmpeg output options that write a rendition as
+// CMAF segments (init.mp4 + seg_NNNNN.m4s) with an HLS media playlist
+func cmafSegmentArgs(renditionDir string, segmentSeconds int) []string {
+	return []string{
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(segmentSeconds),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_type", "fmp4",
+		"-hls_fmp4_init_filename", "init.mp4",
+		"-hls_segment_filename", filepath.Join(renditionDir, "seg_%05d.m4s"),
+		"-start_number", "1",
+		filepath.Join(renditionDir, "playlist.m3u8"),
+	}
+}
 
-		if err := os.MkdirAll(variantDir, 0755); err != nil {
-			return fmt.Errorf("failed to create variant directory: %w", err)
-		}
+// encodeVideoRendition encodes a single video-only CMAF rendition
+func encodeVideoRendition(ctx context.Context, inputFile, outputDir string, res Resolution, profile EncodingProfile, progress *progressTracker) error {
+	variantName := renditionName(res)
+	variantDir := filepath.Join(outputDir, variantName)
 
-		variantPlaylist := filepath.Join(variantDir, "playlist.m3u8")
-
-		args := []string{
-			"-i", inputFile,
-			"-c:v", "libx264",
-			"-preset", "medium",
-			"-profile:v", "main",
-			"-crf", "23",
-			"-sc_threshold", "0",
-			"-g", "60",
-			"-keyint_min", "60",
-			"-hls_time", "6",
-			"-hls_list_size", "0",
-			"-hls_segment_filename", filepath.Join(variantDir, "segment_%03d.ts"),
-			"-vf", fmt.Sprintf("scale=%d:%d", res.Width, res.Height),
-			"-b:v", getBitrateForHeight(res.Height),
-		}
+	if err := os.MkdirAll(variantDir, 0755); err != nil {
+		return fmt.Errorf("failed to create variant directory: %w", err)
+	}
 
-		// Add audio only if available
-		if hasAudio {
-			args = append(args,
-				"-map", "0:v:0",
-				"-map", "0:a:0?", // The ? makes this mapping optional
-				"-c:a", "aac",
-				"-b:a", "128k",
-			)
-		} else {
-			args = append(args, "-map", "0:v:0")
-		}
+	args := []string{
+		"-y",
+		"-i", inputFile,
+		"-map", "0:v:0",
+		"-an",
+	}
+	args = append(args, profile.videoCodecArgs()...)
+	args = append(args, threadArgs()...)
+	args = append(args,
+		// Keyframes on a fixed time grid keep segments aligned across renditions
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", profile.GOPSeconds),
+		"-sc_threshold", "0",
+		"-vf", fmt.Sprintf("scale=%d:%d", res.Width, res.Height),
+		"-b:v", res.Bitrate,
+	)
+	args = append(args, cmafSegmentArgs(variantDir, profile.SegmentSeconds)...)
 
-		args = append(args, variantPlaylist)
+	output, err := runFFmpeg(ctx, args, progress.report)
+	appendJobLog(outputDir, "video rendition "+variantName, args, output)
+	if err != nil {
+		return toolFailure("ffmpeg encoding error for "+variantName, err, output)
+	}
 
-		cmd := exec.Command("ffmpeg", args...)
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("ffmpeg error for %dp: %w - %s", res.Height, err, string(output))
-		}
+	return nil
+}
 
-		// Write entry to master playlist for this variant
-		if i == 0 {
-			// Initialize master playlist
-			if err := os.WriteFile(masterPlaylist, []byte("#EXTM3U\n#EXT-X-VERSION:3\n"), 0644); err != nil {
-				return fmt.Errorf("failed to initialize master playlist: %w", err)
-			}
-		}
+// encodeAudioRendition encodes the first audio track as an AAC CMAF rendition
+func encodeAudioRendition(ctx context.Context, inputFile, outputDir string, profile EncodingProfile, progress *progressTracker) error {
+	audioDir := filepath.Join(outputDir, "audio")
 
-		// Append to master playlist
-		entry := fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%s,RESOLUTION=%dx%d,NAME=%s\n%s/playlist.m3u8\n",
-			getBandwidthForHeight(res.Height),
-			res.Width, res.Height,
-			variantName,
-			variantName)
+	if err := os.MkdirAll(audioDir, 0755); err != nil {
+		return fmt.Errorf("failed to create audio directory: %w", err)
+	}
 
-		f, err := os.OpenFile(masterPlaylist, os.O_APPEND|os.O_WRONLY, 0644)
-		if err != nil {
-			return fmt.Errorf("failed to open master playlist: %w", err)
-		}
-		defer f.Close()
+	args := []string{
+		"-y",
+		"-i", inputFile,
+		"-map", "0:a:0",
+		"-vn",
+		"-c:a", profile.AudioCodec,
+		"-b:a", profile.AudioBitrate,
+		"-ac", strconv.Itoa(profile.AudioChannels),
+	}
+	args = append(args, threadArgs()...)
+	args = append(args, cmafSegmentArgs(audioDir, profile.SegmentSeconds)...)
 
-		if _, err := f.WriteString(entry); err != nil {
-			return fmt.Errorf("failed to write to master playlist: %w", err)
-		}
+	output, err := runFFmpeg(ctx, args, progress.report)
+	appendJobLog(outputDir, "audio rendition", args, output)
+	if err != nil {
+		return toolFailure("ffmpeg encoding error for audio", err, output)
 	}
 
 	return nil
 }
 
-// calculateResolutions calculates scaled resolutions maintaining aspect ratio
-func calculateResolutions(origWidth, origHeight int) []Resolution {
-	// Target heights
-	targetHeights := []int{240, 360, 480, 720, 1080}
+// generateDASH writes the MPEG-DASH manifest for the shared CMAF renditions
+func generateDASH(outputDir, renditionsDir, jobID string, source *mediaProbe, resVariants []Resolution, hasAudio bool, profile EncodingProfile) error {
+	mpd := buildMPD(jobID, renditionsDir, source, resVariants, hasAudio, profile)
+	return writeMPD(mpd, filepath.Join(outputDir, "manifest.mpd"))
+}
+
+// generateHLS writes the HLS master playlist for the shared CMAF renditions.
+// The media playlists are written by ffmpeg next to the segments.
+func generateHLS(outputDir, renditionsDir, jobID string, source *mediaProbe, resVariants []Resolution, hasAudio bool, profile EncodingProfile) error {
+	master := buildHLSMaster(jobID, renditionsDir, source, resVariants, hasAudio, profile)
+	return writeHLSMaster(master, renditionsDir, filepath.Join(outputDir, "master.m3u8"))
+}
 
+// calculateResolutions calculates scaled resolutions from a ladder maintaining aspect ratio
+func calculateResolutions(origWidth, origHeight int, ladder []LadderRung) []Resolution {
 	// Calculate aspect ratio
 	aspectRatio := float64(origWidth) / float64(origHeight)
 
 	// Create resolutions that maintain aspect ratio
 	var resolutions []Resolution
 
-	for _, h := range targetHeights {
+	for _, rung := range ladder {
 		// Skip resolutions higher than the original
-		if h > origHeight {
+		if rung.Height > origHeight {
 			continue
 		}
 
 		// Calculate width that maintains aspect ratio
-		w := int(math.Round(float64(h) * aspectRatio))
+		w := int(math.Round(float64(rung.Height) * aspectRatio))
 
 		// Make width even (required by some codecs)
 		if w%2 != 0 {
@@ -575,13 +833,14 @@ func calculateResolutions(origWidth, origHeight int) []Resolution {
 		}
 
 		resolutions = append(resolutions, Resolution{
-			Width:  w,
-			Height: h,
+			Width:   w,
+			Height:  rung.Height,
+			Bitrate: rung.VideoBitrate,
 		})
 	}
 
 	// If no resolutions were added (e.g., very small source video), add the original
-	if len(resolutions) == 0 {
+	if len(resolutions) == 0 && len(ladder) > 0 {
 		// Make dimensions even
 		if origWidth%2 != 0 {
 			origWidth++
@@ -590,61 +849,26 @@ func calculateResolutions(origWidth, origHeight int) []Resolution {
 			origHeight++
 		}
 
+		// Use the bitrate of the lowest rung in the ladder
 		resolutions = append(resolutions, Resolution{
-			Width:  origWidth,
-			Height: origHeight,
+			Width:   origWidth,
+			Height:  origHeight,
+			Bitrate: ladder[0].VideoBitrate,
 		})
 	}
 
 	return resolutions
 }
 
-// getBitrateForHeight returns an appropriate bitrate for the given resolution height
-func getBitrateForHeight(height int) string {
-	switch {
-	case height <= 240:
-		return "400k"
-	case height <= 360:
-		return "800k"
-	case height <= 480:
-		return "1200k"
-	case height <= 720:
-		return "2500k"
-	case height <= 1080:
-		return "5000k"
-	default:
-		return "1500k"
-	}
-}
-
-// getBandwidthForHeight returns an approximate bandwidth value for the master playlist
-func getBandwidthForHeight(height int) string {
-	switch {
-	case height <= 240:
-		return "528000" // 400k video + 128k audio
-	case height <= 360:
-		return "928000" // 800k video + 128k audio
-	case height <= 480:
-		return "1328000" // 1200k video + 128k audio
-	case height <= 720:
-		return "2628000" // 2500k video + 128k audio
-	case height <= 1080:
-		return "5128000" // 5000k video + 128k audio
-	default:
-		return "1628000" // 1500k video + 128k audio
-	}
-}
-
 // createThumbnail generates a thumbnail for the video
-func createThumbnail(inputFile, outputFile string) error {
+func createThumbnail(ctx context.Context, inputFile, outputFile string) error {
 	// Ensure the output directory exists
 	if err := os.MkdirAll(filepath.Dir(outputFile), 0755); err != nil {
 		return err
 	}
 
 	// Extract a frame at 10% into the video
-	cmd := exec.Command(
-		"ffmpeg",
+	cmd := ffmpegCommand(ctx,
 		"-i", inputFile,
 		"-ss", "00:00:03",
 		"-frames:v", "1",
@@ -652,94 +876,10 @@ func createThumbnail(inputFile, outputFile string) error {
 		outputFile,
 	)
 
-	return cmd.Run()
-}
-
-// watchForNewFiles monitors the media directory for new files and automatically creates encoding jobs
-func watchForNewFiles() {
-	// Initial processing of existing files
-	processExistingFiles()
-
-	// Watch for new files
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			processExistingFiles()
-		}
-	}
-}
-
-// processExistingFiles checks for unprocessed files and creates jobs for them
-func processExistingFiles() {
-	alreadyProcessedFiles := make(map[string]bool)
-
-	// Collect all jobs that already have a source file
-	jobsMutex.RLock()
-	for _, job := range activeJobs {
-		alreadyProcessedFiles[job.SourceFile] = true
-	}
-	for _, job := range completedJobs {
-		alreadyProcessedFiles[job.SourceFile] = true
-	}
-	for _, job := range failedJobs {
-		alreadyProcessedFiles[job.SourceFile] = true
-	}
-	jobsMutex.RUnlock()
-
-	// Check for new files
-	err := filepath.WalkDir(mediaDir, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// Skip directories
-		if d.IsDir() {
-			return nil
-		}
-
-		// Only process video files
-		if !isVideoFile(path) {
-			return nil
-		}
-
-		// Get the relative path to use as the source file ID
-		relPath, err := filepath.Rel(mediaDir, path)
-		if err != nil {
-			return err
-		}
-
-		// Skip if already processed
-		if alreadyProcessedFiles[relPath] {
-			return nil
-		}
-
-		// Create a new job
-		jobID := fmt.Sprintf("job_%d", time.Now().UnixNano())
-		job := EncodingJob{
-			ID:         jobID,
-			SourceFile: relPath,
-			Status:     "pending",
-			Progress:   0,
-			CreatedAt:  time.Now(),
-		}
-
-		// Add to queue
-		jobsMutex.Lock()
-		activeJobs[jobID] = job
-		jobsMutex.Unlock()
-
-		log.Printf("New encoding job created for file: %s", relPath)
-		jobQueue <- job
-
-		return nil
-	})
-
-	if err != nil {
-		log.Printf("Error scanning media directory: %v", err)
+	if err := startLimited(cmd); err != nil {
+		return err
 	}
+	return cmd.Wait()
 }
 
 // isVideoFile checks if the file is a video based on its extension
@@ -764,6 +904,9 @@ func submitJobHandler(w http.ResponseWriter, r *http.Request) {
 
 	var request struct {
 		SourceFile string `json:"source_file"`
+		Profile    string `json:"profile"`
+		Owner      string `json:"owner"`
+		Priority   *int   `json:"priority"` // defaults to the source directory's priority
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
@@ -776,9 +919,28 @@ func submitJobHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Verify the file exists
-	sourceFilePath := filepath.Join(mediaDir, request.SourceFile)
-	if _, err := os.Stat(sourceFilePath); os.IsNotExist(err) {
+	profile, ok := getProfile(request.Profile)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown encoding profile: %s", request.Profile), http.StatusBadRequest)
+		return
+	}
+
+	priority := sourcePriority(request.SourceFile)
+	if request.Priority != nil {
+		if !validPriority(*request.Priority) {
+			http.Error(w, fmt.Sprintf("Priority must be between %d and %d", minPriority, maxPriority), http.StatusBadRequest)
+			return
+		}
+		priority = *request.Priority
+	}
+
+	// Verify the file exists inside the media directory
+	sourceFilePath, err := safepath.Resolve(mediaDir, request.SourceFile)
+	if err == safepath.ErrUnsafe {
+		http.Error(w, "Invalid source file", http.StatusBadRequest)
+		return
+	}
+	if info, statErr := os.Stat(sourceFilePath); err != nil || statErr != nil || !info.Mode().IsRegular() {
 		http.Error(w, "Source file not found", http.StatusNotFound)
 		return
 	}
@@ -788,85 +950,156 @@ func submitJobHandler(w http.ResponseWriter, r *http.Request) {
 	job := EncodingJob{
 		ID:         jobID,
 		SourceFile: request.SourceFile,
+		Profile:    profile.Name,
+		Owner:      request.Owner,
+		Priority:   priority,
 		Status:     "pending",
 		Progress:   0,
 		CreatedAt:  time.Now(),
 	}
 
-	// Add to queue
+	// Add to queue. A matching job that is pending, processing or completed is
+	// returned instead, so repeated notifications for one upload are idempotent
+	// and deduplicated uploads reuse the existing encoded outputs.
 	jobsMutex.Lock()
+	if existing, exists := findReusableJob(request.SourceFile, profile.Name); exists {
+		positions := pendingJobs.positions()
+		jobsMutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(withQueuePosition(existing, positions))
+		return
+	}
+
+	// Send to processing queue; a full queue is reported rather than waited on
+	if err := pendingJobs.tryPush(job); err != nil {
+		jobsMutex.Unlock()
+		log.Printf("Rejected encoding job for %s: %v", request.SourceFile, err)
+		writeQueueFull(w)
+		return
+	}
 	activeJobs[jobID] = job
+	saveJob(job)
+	publishJobEvent(eventJobCreated, job)
+	job = withQueuePosition(job, pendingJobs.positions())
 	jobsMutex.Unlock()
 
-	// Send to processing queue
-	jobQueue <- job
-
 	// Return job details
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(job)
 }
 
-// listJobsHandler returns a list of all jobs
-func listJobsHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+// jobsHandler routes requests for the job collection
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listJobsHandler(w, r)
+	case http.MethodDelete:
+		deleteSourceJobsHandler(w, r)
+	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
 	}
+}
+
+// listJobsHandler returns a list of all jobs
+func listJobsHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Get query parameters
 	statusFilter := r.URL.Query().Get("status")
 
+	// Optionally restrict to jobs for the given source files
+	var sourceFilter map[string]bool
+	if sources := r.URL.Query()["source_file"]; len(sources) > 0 {
+		sourceFilter = make(map[string]bool, len(sources))
+		for _, source := range sources {
+			sourceFilter[source] = true
+		}
+	}
+
 	// Collect jobs
 	jobsMutex.RLock()
 	defer jobsMutex.RUnlock()
 
 	var jobs []EncodingJob
+	positions := pendingJobs.positions()
+	addJobs := func(from map[string]EncodingJob) {
+		for _, job := range from {
+			if sourceFilter == nil || sourceFilter[job.SourceFile] {
+				jobs = append(jobs, withQueuePosition(job, positions))
+			}
+		}
+	}
 
 	// Add jobs based on status filter
 	if statusFilter == "" || statusFilter == "active" {
-		for _, job := range activeJobs {
-			jobs = append(jobs, job)
-		}
+		addJobs(activeJobs)
 	}
 
 	if statusFilter == "" || statusFilter == "completed" {
-		for _, job := range completedJobs {
-			jobs = append(jobs, job)
-		}
+		addJobs(completedJobs)
 	}
 
 	if statusFilter == "" || statusFilter == "failed" {
-		for _, job := range failedJobs {
-			jobs = append(jobs, job)
-		}
+		addJobs(failedJobs)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(jobs)
 }
 
-// getJobHandler returns details for a specific job
-func getJobHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// Extract job ID from URL path
-	jobID := strings.TrimPrefix(r.URL.Path, "/jobs/")
+// jobHandler routes requests for a single job and its actions
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	// Extract job ID and optional action from URL path
+	jobID, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
 	if jobID == "" {
 		http.Error(w, "Job ID is required", http.StatusBadRequest)
 		return
 	}
 
+	switch action {
+	case "":
+		switch r.Method {
+		case http.MethodGet:
+			getJobHandler(w, r, jobID)
+		case http.MethodDelete:
+			deleteJobHandler(w, r, jobID)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case "cancel":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		cancelJobHandler(w, r, jobID)
+	case "retry":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		retryJobHandler(w, r, jobID)
+	case "log":
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		jobLogHandler(w, r, jobID)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// getJobHandler returns details for a specific job
+func getJobHandler(w http.ResponseWriter, r *http.Request, jobID string) {
 	// Look up the job
 	jobsMutex.RLock()
 	defer jobsMutex.RUnlock()
 
 	if job, exists := activeJobs[jobID]; exists {
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(job)
+		json.NewEncoder(w).Encode(withQueuePosition(job, pendingJobs.positions()))
 		return
 	}
 
@@ -885,6 +1118,199 @@ func getJobHandler(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "Job not found", http.StatusNotFound)
 }
 
+// cancelJobHandler stops a pending or processing job
+func cancelJobHandler(w http.ResponseWriter, r *http.Request, jobID string) {
+	jobsMutex.Lock()
+	job, exists := activeJobs[jobID]
+	if !exists {
+		jobsMutex.Unlock()
+		if jobExists(jobID) {
+			http.Error(w, "Job is not active", http.StatusConflict)
+		} else {
+			http.Error(w, "Job not found", http.StatusNotFound)
+		}
+		return
+	}
+
+	if cancel, running := runningJobs[jobID]; running {
+		// Kill ffmpeg; the worker records the cancellation once it exits
+		cancel()
+		jobsMutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job)
+		return
+	}
+
+	// Still queued: free its slot right away
+	pendingJobs.remove(jobID)
+	job.Status = "cancelled"
+	job.ErrorMessage = "cancelled by request"
+	failedJobs[jobID] = job
+	delete(activeJobs, jobID)
+	saveJob(job)
+	publishJobEvent(eventJobCancelled, job)
+	jobsMutex.Unlock()
+
+	log.Printf("Job %s cancelled before processing", jobID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// retryJobHandler moves a failed or cancelled job back into the queue
+func retryJobHandler(w http.ResponseWriter, r *http.Request, jobID string) {
+	jobsMutex.Lock()
+	job, exists := failedJobs[jobID]
+	if !exists {
+		jobsMutex.Unlock()
+		if jobExists(jobID) {
+			http.Error(w, "Only failed or cancelled jobs can be retried", http.StatusConflict)
+		} else {
+			http.Error(w, "Job not found", http.StatusNotFound)
+		}
+		return
+	}
+
+	// Send to processing queue; a full queue is reported rather than waited on
+	if err := pendingJobs.tryPush(job); err != nil {
+		jobsMutex.Unlock()
+		writeQueueFull(w)
+		return
+	}
+
+	job.Status = "pending"
+	job.Progress = 0
+	job.ErrorMessage = ""
+	job.ErrorCode = ""
+	job.Attempts = 0
+	job.NextRetryAt = nil
+	job.StartedAt = time.Time{}
+	job.CompletedAt = time.Time{}
+	activeJobs[jobID] = job
+	delete(failedJobs, jobID)
+	saveJob(job)
+	publishJobEvent(eventJobRetried, job)
+	job = withQueuePosition(job, pendingJobs.positions())
+	jobsMutex.Unlock()
+
+	log.Printf("Retrying job %s: %s", jobID, job.SourceFile)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// deleteJobHandler removes a job and all of its output files
+func deleteJobHandler(w http.ResponseWriter, r *http.Request, jobID string) {
+	jobsMutex.Lock()
+	if !jobExists(jobID) {
+		jobsMutex.Unlock()
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	forgetJob(jobID)
+	jobsMutex.Unlock()
+
+	removeJobOutputs(jobID)
+	log.Printf("Job %s deleted", jobID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteSourceJobsHandler deletes every job for a source file and their outputs.
+// The catalog service calls it when a file is permanently deleted.
+func deleteSourceJobsHandler(w http.ResponseWriter, r *http.Request) {
+	sourceFile := r.URL.Query().Get("source_file")
+	if sourceFile == "" {
+		http.Error(w, "source_file is required", http.StatusBadRequest)
+		return
+	}
+
+	var jobIDs []string
+	jobsMutex.Lock()
+	for _, jobs := range []map[string]EncodingJob{activeJobs, completedJobs, failedJobs} {
+		for id, job := range jobs {
+			if job.SourceFile == sourceFile {
+				jobIDs = append(jobIDs, id)
+			}
+		}
+	}
+	for _, id := range jobIDs {
+		forgetJob(id)
+	}
+	jobsMutex.Unlock()
+
+	for _, id := range jobIDs {
+		removeJobOutputs(id)
+	}
+	log.Printf("Deleted %d jobs for %s", len(jobIDs), sourceFile)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// forgetJob stops a job if it is running and removes it from memory and the
+// store. Its outputs are left for the caller to remove. Callers must hold jobsMutex.
+func forgetJob(jobID string) {
+	// Stop ffmpeg first; the worker cleans up again when it notices the job is gone
+	if cancel, running := runningJobs[jobID]; running {
+		cancel()
+	}
+	pendingJobs.remove(jobID)
+
+	if !jobExists(jobID) {
+		return
+	}
+	delete(activeJobs, jobID)
+	delete(completedJobs, jobID)
+	delete(failedJobs, jobID)
+	if jobStore != nil {
+		if err := jobStore.Delete(jobID); err != nil {
+			log.Printf("Error removing job %s from store: %v", jobID, err)
+		}
+	}
+	publishJobDeleted(jobID)
+}
+
+// hasJobForSource reports whether any job exists for a source file. Callers must hold jobsMutex.
+func hasJobForSource(sourceFile string) bool {
+	for _, jobs := range []map[string]EncodingJob{activeJobs, completedJobs, failedJobs} {
+		for _, job := range jobs {
+			if job.SourceFile == sourceFile {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// findReusableJob returns a pending, processing or completed job for a source
+// file and profile. Callers must hold jobsMutex.
+func findReusableJob(sourceFile, profile string) (EncodingJob, bool) {
+	for _, jobs := range []map[string]EncodingJob{activeJobs, completedJobs} {
+		for _, job := range jobs {
+			if job.SourceFile == sourceFile && job.Profile == profile {
+				return job, true
+			}
+		}
+	}
+	return EncodingJob{}, false
+}
+
+// jobExists reports whether a job is known in any state. Callers must hold jobsMutex.
+func jobExists(jobID string) bool {
+	if _, exists := activeJobs[jobID]; exists {
+		return true
+	}
+	if _, exists := completedJobs[jobID]; exists {
+		return true
+	}
+	_, exists := failedJobs[jobID]
+	return exists
+}
+
 // listStreamsHandler returns a list of all available streams
 func listStreamsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -897,31 +1323,11 @@ func listStreamsHandler(w http.ResponseWriter, r *http.Request) {
 	// Find all completed jobs that have DASH/HLS output
 	jobsMutex.RLock()
 	for _, job := range completedJobs {
+		if job.Suspended {
+			continue
+		}
 		if job.DashManifest != "" || job.HlsManifest != "" {
-			// Extract original filename from source file
-			originalFile := job.SourceFile
-			parts := strings.SplitN(originalFile, "_", 2)
-			filename := originalFile
-			if len(parts) > 1 {
-				filename = parts[1]
-			}
-
-			// Get video duration if possible
-			sourceFilePath := filepath.Join(mediaDir, job.SourceFile)
-			duration := getVideoDuration(sourceFilePath)
-
-			stream := Stream{
-				ID:           job.ID,
-				OriginalFile: job.SourceFile,
-				Title:        filename,
-				DashURL:      job.DashManifest,
-				HlsURL:       job.HlsManifest,
-				Thumbnail:    fmt.Sprintf("/encoded/%s/thumbnail.jpg", job.ID),
-				Duration:     duration,
-				CreatedAt:    job.CompletedAt,
-			}
-
-			streams = append(streams, stream)
+			streams = append(streams, newStream(job))
 		}
 	}
 	jobsMutex.RUnlock()
@@ -930,8 +1336,52 @@ func listStreamsHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(streams)
 }
 
+// newStream describes the playable output of a completed job
+func newStream(job EncodingJob) Stream {
+	// Extract original filename from source file
+	originalFile := job.SourceFile
+	parts := strings.SplitN(originalFile, "_", 2)
+	filename := originalFile
+	if len(parts) > 1 {
+		filename = parts[1]
+	}
+
+	// Use the duration recorded while encoding, probing older jobs
+	duration := int(math.Round(job.Duration))
+	if duration == 0 {
+		duration = getVideoDuration(filepath.Join(mediaDir, job.SourceFile))
+	}
+
+	thumbnail := job.Thumbnail
+	if thumbnail == "" {
+		thumbnail = fmt.Sprintf("/encoded/%s/thumbnail.jpg", job.ID)
+	}
+
+	return Stream{
+		ID:           job.ID,
+		OriginalFile: job.SourceFile,
+		Title:        filename,
+		DashURL:      job.DashManifest,
+		HlsURL:       job.HlsManifest,
+		Thumbnail:    thumbnail,
+		Duration:     duration,
+		CreatedAt:    job.CompletedAt,
+	}
+}
+
 // getVideoDuration gets the duration of a video file in seconds
 func getVideoDuration(inputFile string) int {
+	durFloat, err := getVideoDurationSeconds(inputFile)
+	if err != nil {
+		log.Printf("Error getting video duration: %v", err)
+		return 0
+	}
+
+	return int(math.Round(durFloat))
+}
+
+// getVideoDurationSeconds gets the exact duration of a video file in seconds
+func getVideoDurationSeconds(inputFile string) (float64, error) {
 	cmd := exec.Command(
 		"ffprobe",
 		"-v", "error",
@@ -942,19 +1392,17 @@ func getVideoDuration(inputFile string) int {
 
 	output, err := cmd.Output()
 	if err != nil {
-		log.Printf("Error getting video duration: %v", err)
-		return 0
+		return 0, err
 	}
 
 	// Parse output to get duration in seconds
 	durStr := strings.TrimSpace(string(output))
 	durFloat, err := strconv.ParseFloat(durStr, 64)
 	if err != nil {
-		log.Printf("Error parsing duration: %v", err)
-		return 0
+		return 0, fmt.Errorf("invalid duration value: %w", err)
 	}
 
-	return int(math.Round(durFloat))
+	return durFloat, nil
 }
 
 // healthCheckHandler is a simple health check endpoint
@@ -964,12 +1412,35 @@ func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
 }
 
-// updateJob updates the status of a job
+// updateJob updates the status of an active job. Progress alone is not
+// journaled, as interrupted jobs start over after a restart anyway.
 func updateJob(job EncodingJob) {
 	jobsMutex.Lock()
 	defer jobsMutex.Unlock()
 
+	// Ignore late updates for jobs that were cancelled or deleted meanwhile
+	current, exists := activeJobs[job.ID]
+	if !exists {
+		return
+	}
+	// The worker's copy predates a suspension made while it was running
+	job.Suspended = current.Suspended
+
 	activeJobs[job.ID] = job
+	if job.Status != current.Status {
+		saveJob(job)
+	}
+	publishJobEvent(eventJobProgress, job)
+}
+
+// saveJob writes the job to the persistent store, logging any failure
+func saveJob(job EncodingJob) {
+	if jobStore == nil {
+		return
+	}
+	if err := jobStore.Save(job); err != nil {
+		log.Printf("Error persisting job %s: %v", job.ID, err)
+	}
 }
 
 // thumbnailDirectHandler serves thumbnail images directly
@@ -984,11 +1455,23 @@ func thumbnailDirectHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	thumbnailPath := filepath.Join(encodedDir, jobID, "thumbnail.jpg")
+	thumbnailPath, err := safepath.Resolve(encodedDir, filepath.Join(jobID, "thumbnail.jpg"))
+	if err == safepath.ErrUnsafe {
+		log.Printf("Rejected thumbnail request for invalid job ID: %q", jobID)
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+	if jobSuspended(jobID) {
+		http.Error(w, "Thumbnail not found", http.StatusNotFound)
+		return
+	}
 	log.Printf("Attempting to serve thumbnail from %s", thumbnailPath)
 
 	// Check if the file exists
-	if _, err := os.Stat(thumbnailPath); err != nil {
+	if err == nil {
+		_, err = os.Stat(thumbnailPath)
+	}
+	if err != nil {
 		log.Printf("Error checking thumbnail file: %v", err)
 		if os.IsNotExist(err) {
 			// List the encoded directory to debug
@@ -1025,3 +1508,19 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+func getEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(getEnv(key, ""))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(getEnv(key, ""))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MPD is the root element of an MPEG-DASH media presentation description
+type MPD struct {
+	XMLName                   xml.Name `xml:"MPD"`
+	Xmlns                     string   `xml:"xmlns,attr"`
+	Profiles                  string   `xml:"profiles,attr"`
+	Type                      string   `xml:"type,attr"`
+	MediaPresentationDuration string   `xml:"mediaPresentationDuration,attr"`
+	MinBufferTime             string   `xml:"minBufferTime,attr"`
+	BaseURL                   string   `xml:"BaseURL,omitempty"`
+	Periods                   []Period `xml:"Period"`
+}
+
+// Period is a single time span of the presentation
+type Period struct {
+	ID             string          `xml:"id,attr"`
+	Start          string          `xml:"start,attr"`
+	Duration       string          `xml:"duration,attr"`
+	AdaptationSets []AdaptationSet `xml:"AdaptationSet"`
+}
+
+// AdaptationSet groups interchangeable encodings of one content component
+type AdaptationSet struct {
+	ID               int              `xml:"id,attr"`
+	ContentType      string           `xml:"contentType,attr"`
+	MimeType         string           `xml:"mimeType,attr"`
+	SegmentAlignment bool             `xml:"segmentAlignment,attr"`
+	StartWithSAP     int              `xml:"startWithSAP,attr,omitempty"`
+	MaxWidth         int              `xml:"maxWidth,attr,omitempty"`
+	MaxHeight        int              `xml:"maxHeight,attr,omitempty"`
+	MaxFrameRate     string           `xml:"maxFrameRate,attr,omitempty"`
+	Par              string           `xml:"par,attr,omitempty"`
+	Lang             string           `xml:"lang,attr,omitempty"`
+	SegmentTemplate  *SegmentTemplate `xml:"SegmentTemplate,omitempty"`
+	Representations  []Representation `xml:"Representation"`
+}
+
+// Representation is one encoding of the content (a rendition)
+type Representation struct {
+	ID                        string           `xml:"id,attr"`
+	Codecs                    string           `xml:"codecs,attr"`
+	Bandwidth                 int64            `xml:"bandwidth,attr"`
+	Width                     int              `xml:"width,attr,omitempty"`
+	Height                    int              `xml:"height,attr,omitempty"`
+	FrameRate                 string           `xml:"frameRate,attr,omitempty"`
+	Sar                       string           `xml:"sar,attr,omitempty"`
+	AudioSamplingRate         int              `xml:"audioSamplingRate,attr,omitempty"`
+	AudioChannelConfiguration *Descriptor      `xml:"AudioChannelConfiguration,omitempty"`
+	SegmentTemplate           *SegmentTemplate `xml:"SegmentTemplate,omitempty"` // only when segments differ between renditions
+}
+
+// SegmentTemplate describes how segment URLs are built for each Representation.
+// Segment times come from SegmentTimeline, or from Duration if it is unknown.
+type SegmentTemplate struct {
+	Timescale       int              `xml:"timescale,attr"`
+	Duration        int              `xml:"duration,attr,omitempty"`
+	StartNumber     int              `xml:"startNumber,attr"`
+	Initialization  string           `xml:"initialization,attr"`
+	Media           string           `xml:"media,attr"`
+	SegmentTimeline *SegmentTimeline `xml:"SegmentTimeline,omitempty"`
+}
+
+// SegmentTimeline lists the exact start and duration of every segment
+type SegmentTimeline struct {
+	Segments []TimelineSegment `xml:"S"`
+}
+
+// TimelineSegment describes R+1 consecutive segments of duration D, the first
+// starting at T, or right after the previous segment if T is unset
+type TimelineSegment struct {
+	T *int64 `xml:"t,attr,omitempty"`
+	D int64  `xml:"d,attr"`
+	R int    `xml:"r,attr,omitempty"`
+}
+
+// Descriptor is a generic DASH scheme/value pair
+type Descriptor struct {
+	SchemeIDURI string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr"`
+}
+
+// Timescale used for SegmentTemplate times (the 90 kHz MPEG clock)
+const mpdTimescale = 90000
+
+// renditionSegmentTemplate returns the template matching the files written by
+// cmafSegmentArgs. Without a timeline every segment is assumed to last segmentSeconds.
+func renditionSegmentTemplate(segmentSeconds int, timeline *SegmentTimeline) *SegmentTemplate {
+	template := &SegmentTemplate{
+		Timescale:       mpdTimescale,
+		StartNumber:     1,
+		Initialization:  "$RepresentationID$/init.mp4",
+		Media:           "$RepresentationID$/seg_$Number%05d$.m4s",
+		SegmentTimeline: timeline,
+	}
+	if timeline == nil {
+		template.Duration = segmentSeconds * mpdTimescale
+	}
+	return template
+}
+
+// renditionTimeline returns the timeline of the segments ffmpeg wrote for a
+// rendition, read from its media playlist, or nil if it cannot be read
+func renditionTimeline(dir string) *SegmentTimeline {
+	durations, err := readSegmentDurations(filepath.Join(dir, "playlist.m3u8"))
+	if err != nil {
+		log.Printf("Warning: Could not read segment durations of %s, assuming nominal ones: %v", filepath.Base(dir), err)
+		return nil
+	}
+	return buildSegmentTimeline(durations)
+}
+
+// readSegmentDurations returns the #EXTINF durations of a media playlist, in seconds
+func readSegmentDurations(playlistPath string) ([]float64, error) {
+	data, err := os.ReadFile(playlistPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var durations []float64
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "#EXTINF:") {
+			continue
+		}
+		value, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+		duration, err := strconv.ParseFloat(value, 64)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid segment duration %q", value)
+		}
+		durations = append(durations, duration)
+	}
+
+	if len(durations) == 0 {
+		return nil, fmt.Errorf("no segments in %s", playlistPath)
+	}
+	return durations, nil
+}
+
+// buildSegmentTimeline converts segment durations in seconds to a timeline,
+// merging runs of equal durations. Segment boundaries are rounded rather than
+// the durations, so rounding errors do not add up over long presentations.
+func buildSegmentTimeline(durations []float64) *SegmentTimeline {
+	start := int64(0)
+	timeline := &SegmentTimeline{
+		Segments: []TimelineSegment{{T: &start}},
+	}
+
+	var elapsed float64
+	var previousEnd int64
+	for i, duration := range durations {
+		elapsed += duration
+		end := int64(math.Round(elapsed * mpdTimescale))
+		d := end - previousEnd
+		previousEnd = end
+
+		last := &timeline.Segments[len(timeline.Segments)-1]
+		switch {
+		case i == 0:
+			last.D = d
+		case last.D == d:
+			last.R++
+		default:
+			timeline.Segments = append(timeline.Segments, TimelineSegment{D: d})
+		}
+	}
+	return timeline
+}
+
+// sameTimeline reports whether two timelines describe the same segments
+func sameTimeline(a, b *SegmentTimeline) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if len(a.Segments) != len(b.Segments) {
+		return false
+	}
+	for i := range a.Segments {
+		if a.Segments[i].D != b.Segments[i].D || a.Segments[i].R != b.Segments[i].R {
+			return false
+		}
+	}
+	return true
+}
+
+// buildMPD assembles the manifest for a job's CMAF renditions. source is the
+// probe of the input file; renditionsDir holds one directory per rendition.
+func buildMPD(jobID, renditionsDir string, source *mediaProbe, resVariants []Resolution, hasAudio bool, profile EncodingProfile) *MPD {
+	duration := source.duration()
+	sourceVideo := source.videoStream()
+
+	video := AdaptationSet{
+		ID:               1,
+		ContentType:      "video",
+		MimeType:         "video/mp4",
+		SegmentAlignment: true,
+		StartWithSAP:     1,
+	}
+	if sourceVideo != nil {
+		video.MaxFrameRate = sourceVideo.frameRate()
+		video.Par = sourceVideo.pictureAspectRatio()
+	}
+
+	var timelines []*SegmentTimeline
+	for _, res := range resVariants {
+		name := renditionName(res)
+		dir := filepath.Join(renditionsDir, name)
+		timelines = append(timelines, renditionTimeline(dir))
+
+		rep := Representation{
+			ID:     name,
+			Codecs: profile.fallbackCodecString(),
+			Width:  res.Width,
+			Height: res.Height,
+			Sar:    "1:1",
+		}
+		if sourceVideo != nil {
+			rep.FrameRate = sourceVideo.frameRate()
+		}
+
+		// The init segment carries the real codec parameters chosen by the encoder
+		if probe, err := probeMedia(filepath.Join(dir, "init.mp4")); err != nil {
+			log.Printf("Warning: Could not probe %s rendition, using defaults: %v", name, err)
+		} else if stream := probe.videoStream(); stream != nil {
+			rep.Codecs = stream.codecString()
+			rep.Width = stream.Width
+			rep.Height = stream.Height
+			rep.Sar = stream.sampleAspectRatio()
+		}
+
+		_, peak := measureRendition(dir, duration, profile.SegmentSeconds)
+		rep.Bandwidth = peak
+		if rep.Bandwidth == 0 {
+			rep.Bandwidth = bitrateToBps(res.Bitrate)
+		}
+
+		video.MaxWidth = maxInt(video.MaxWidth, rep.Width)
+		video.MaxHeight = maxInt(video.MaxHeight, rep.Height)
+		video.Representations = append(video.Representations, rep)
+	}
+
+	// Keyframes on a shared grid normally give every rendition the same segments,
+	// so players can switch at any boundary. Otherwise each rendition gets its own.
+	aligned := len(timelines) > 0
+	for _, timeline := range timelines {
+		if !sameTimeline(timeline, timelines[0]) {
+			aligned = false
+		}
+	}
+	if aligned {
+		video.SegmentTemplate = renditionSegmentTemplate(profile.SegmentSeconds, timelines[0])
+	} else {
+		log.Printf("Warning: Segments of job %s are not aligned across renditions", jobID)
+		video.SegmentAlignment = false
+		for i := range video.Representations {
+			video.Representations[i].SegmentTemplate = renditionSegmentTemplate(profile.SegmentSeconds, timelines[i])
+		}
+	}
+
+	period := Period{
+		ID:             "0",
+		Start:          "PT0S",
+		Duration:       formatISODuration(duration),
+		AdaptationSets: []AdaptationSet{video},
+	}
+
+	if hasAudio {
+		dir := filepath.Join(renditionsDir, "audio")
+		rep := Representation{
+			ID:     "audio",
+			Codecs: "mp4a.40.2",
+		}
+
+		if probe, err := probeMedia(filepath.Join(dir, "init.mp4")); err != nil {
+			log.Printf("Warning: Could not probe audio rendition, using defaults: %v", err)
+		} else if stream := probe.audioStream(); stream != nil {
+			rep.Codecs = stream.codecString()
+			rep.AudioSamplingRate = stream.sampleRate()
+			if stream.Channels > 0 {
+				rep.AudioChannelConfiguration = &Descriptor{
+					SchemeIDURI: "urn:mpeg:dash:23003:3:audio_channel_configuration:2011",
+					Value:       fmt.Sprintf("%d", stream.Channels),
+				}
+			}
+		}
+
+		_, peak := measureRendition(dir, duration, profile.SegmentSeconds)
+		rep.Bandwidth = peak
+		if rep.Bandwidth == 0 {
+			rep.Bandwidth = bitrateToBps(profile.AudioBitrate)
+		}
+
+		audio := AdaptationSet{
+			ID:               2,
+			ContentType:      "audio",
+			MimeType:         "audio/mp4",
+			SegmentAlignment: true,
+			StartWithSAP:     1,
+			SegmentTemplate:  renditionSegmentTemplate(profile.SegmentSeconds, renditionTimeline(dir)),
+			Representations:  []Representation{rep},
+		}
+		if sourceAudio := source.audioStream(); sourceAudio != nil {
+			audio.Lang = sourceAudio.language()
+		}
+
+		period.AdaptationSets = append(period.AdaptationSets, audio)
+	}
+
+	return &MPD{
+		Xmlns:                     "urn:mpeg:dash:schema:mpd:2011",
+		Profiles:                  "urn:mpeg:dash:profile:isoff-live:2011",
+		Type:                      "static",
+		MediaPresentationDuration: formatISODuration(duration),
+		MinBufferTime:             fmt.Sprintf("PT%dS", profile.SegmentSeconds),
+		BaseURL:                   renditionURL(jobID, ""),
+		Periods:                   []Period{period},
+	}
+}
+
+// writeMPD serializes the manifest to path
+func writeMPD(mpd *MPD, path string) error {
+	data, err := xml.MarshalIndent(mpd, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode DASH manifest: %w", err)
+	}
+
+	content := append([]byte(xml.Header), data...)
+	content = append(content, '\n')
+
+	if err := writeFileAtomic(path, content); err != nil {
+		return fmt.Errorf("failed to write DASH manifest: %w", err)
+	}
+	return nil
+}
+
+// measureRendition returns the average and peak bitrate (bits/s) of a
+// rendition's media segments, or zeros if they cannot be read
+func measureRendition(dir string, duration float64, segmentSeconds int) (int64, int64) {
+	segments, err := filepath.Glob(filepath.Join(dir, "seg_*.m4s"))
+	if err != nil || len(segments) == 0 {
+		return 0, 0
+	}
+	sort.Strings(segments)
+
+	var total, peak int64
+	for i, segment := range segments {
+		info, err := os.Stat(segment)
+		if err != nil {
+			return 0, 0
+		}
+		total += info.Size()
+
+		// The last segment is usually short, so it does not count towards the peak
+		if i < len(segments)-1 || len(segments) == 1 {
+			bps := info.Size() * 8 / int64(segmentSeconds)
+			if bps > peak {
+				peak = bps
+			}
+		}
+	}
+
+	if duration <= 0 {
+		duration = float64(len(segments) * segmentSeconds)
+	}
+	average := int64(float64(total*8) / duration)
+
+	return average, peak
+}
+
+// formatISODuration formats seconds as an ISO 8601 duration (e.g. PT1M23.456S)
+func formatISODuration(seconds float64) string {
+	if seconds <= 0 {
+		return "PT0S"
+	}
+
+	ms := int64(math.Round(seconds * 1000))
+	hours := ms / 3600000
+	ms -= hours * 3600000
+	minutes := ms / 60000
+	ms -= minutes * 60000
+
+	var b strings.Builder
+	b.WriteString("PT")
+	if hours > 0 {
+		fmt.Fprintf(&b, "%dH", hours)
+	}
+	if minutes > 0 {
+		fmt.Fprintf(&b, "%dM", minutes)
+	}
+	if ms > 0 || (hours == 0 && minutes == 0) {
+		secs := strings.TrimRight(strings.TrimRight(fmt.Sprintf("%d.%03d", ms/1000, ms%1000), "0"), ".")
+		fmt.Fprintf(&b, "%sS", secs)
+	}
+	return b.String()
+}
+
+// bitrateToBps converts an ffmpeg bitrate such as "2500k" to bits per second
+func bitrateToBps(bitrate string) int64 {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(bitrate, "k"):
+		multiplier = 1000
+		bitrate = strings.TrimSuffix(bitrate, "k")
+	case strings.HasSuffix(bitrate, "M"):
+		multiplier = 1000000
+		bitrate = strings.TrimSuffix(bitrate, "M")
+	}
+
+	var value int64
+	if _, err := fmt.Sscanf(bitrate, "%d", &value); err != nil {
+		return 0
+	}
+	return value * multiplier
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
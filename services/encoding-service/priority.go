@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Range of job priorities; higher priorities are processed first
+const (
+	minPriority = -100
+	maxPriority = 100
+)
+
+// directoryPriority is the default priority of jobs for source files under a
+// directory of the media directory
+type directoryPriority struct {
+	Dir      string
+	Priority int
+}
+
+// directoryPriorities are configured with DIRECTORY_PRIORITIES, longest directory first
+var directoryPriorities []directoryPriority
+
+// parseDirectoryPriorities parses a comma-separated list of dir=priority pairs
+// with directories relative to the media directory, e.g. "backfill=-10,live=20"
+func parseDirectoryPriorities(spec string) ([]directoryPriority, error) {
+	var priorities []directoryPriority
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		dir, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid entry %q: expected dir=priority", entry)
+		}
+		dir = filepath.Clean(strings.Trim(strings.TrimSpace(dir), "/"))
+		if dir == "." || dir == ".." || strings.HasPrefix(dir, "../") {
+			return nil, fmt.Errorf("invalid directory in %q", entry)
+		}
+
+		priority, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || !validPriority(priority) {
+			return nil, fmt.Errorf("invalid priority in %q: must be between %d and %d", entry, minPriority, maxPriority)
+		}
+
+		priorities = append(priorities, directoryPriority{Dir: dir, Priority: priority})
+	}
+
+	// The most specific directory wins
+	sort.SliceStable(priorities, func(i, j int) bool {
+		return len(priorities[i].Dir) > len(priorities[j].Dir)
+	})
+	return priorities, nil
+}
+
+// validPriority reports whether a priority is within the allowed range
+func validPriority(priority int) bool {
+	return priority >= minPriority && priority <= maxPriority
+}
+
+// sourcePriority returns the default priority of jobs for a source file, from
+// the most specific configured directory containing it
+func sourcePriority(sourceFile string) int {
+	sourceFile = filepath.ToSlash(sourceFile)
+	for _, dp := range directoryPriorities {
+		if strings.HasPrefix(sourceFile, filepath.ToSlash(dp.Dir)+"/") {
+			return dp.Priority
+		}
+	}
+	return 0
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// mediaProbe holds the subset of `ffprobe -show_format -show_streams` output we use
+type mediaProbe struct {
+	Streams []probeStream `json:"streams"`
+	Format  struct {
+		Duration string `json:"duration"`
+		BitRate  string `json:"bit_rate"`
+	} `json:"format"`
+}
+
+// probeStream describes a single stream reported by ffprobe
+type probeStream struct {
+	Index              int               `json:"index"`
+	CodecType          string            `json:"codec_type"`
+	CodecName          string            `json:"codec_name"`
+	Profile            string            `json:"profile"`
+	Level              int               `json:"level"`
+	Width              int               `json:"width"`
+	Height             int               `json:"height"`
+	SampleAspectRatio  string            `json:"sample_aspect_ratio"`
+	DisplayAspectRatio string            `json:"display_aspect_ratio"`
+	RFrameRate         string            `json:"r_frame_rate"`
+	AvgFrameRate       string            `json:"avg_frame_rate"`
+	SampleRate         string            `json:"sample_rate"`
+	Channels           int               `json:"channels"`
+	BitRate            string            `json:"bit_rate"`
+	Tags               map[string]string `json:"tags"`
+}
+
+// probeMedia runs ffprobe on a file and parses its streams and format
+func probeMedia(inputFile string) (*mediaProbe, error) {
+	cmd := exec.Command(
+		"ffprobe",
+		"-v", "error",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		inputFile,
+	)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var probe mediaProbe
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return nil, fmt.Errorf("unexpected ffprobe output: %w", err)
+	}
+
+	return &probe, nil
+}
+
+// videoStream returns the first video stream, or nil if there is none
+func (p *mediaProbe) videoStream() *probeStream {
+	return p.firstStream("video")
+}
+
+// audioStream returns the first audio stream, or nil if there is none
+func (p *mediaProbe) audioStream() *probeStream {
+	return p.firstStream("audio")
+}
+
+func (p *mediaProbe) firstStream(codecType string) *probeStream {
+	for i := range p.Streams {
+		if p.Streams[i].CodecType == codecType {
+			return &p.Streams[i]
+		}
+	}
+	return nil
+}
+
+// duration returns the container duration in seconds (0 if unknown)
+func (p *mediaProbe) duration() float64 {
+	d, err := strconv.ParseFloat(p.Format.Duration, 64)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// frameRate returns the stream frame rate as an MPD-style "N" or "N/D" string
+func (s *probeStream) frameRate() string {
+	for _, rate := range []string{s.RFrameRate, s.AvgFrameRate} {
+		num, den, ok := parseRatio(rate, "/")
+		if !ok || num == 0 {
+			continue
+		}
+		g := gcd(num, den)
+		num, den = num/g, den/g
+		if den == 1 {
+			return strconv.Itoa(num)
+		}
+		return fmt.Sprintf("%d/%d", num, den)
+	}
+	return ""
+}
+
+// frameRateValue returns the stream frame rate in frames per second (0 if unknown)
+func (s *probeStream) frameRateValue() float64 {
+	num, den, ok := parseRatio(s.frameRate(), "/")
+	if !ok {
+		// Integer rates have no denominator
+		rate, _ := strconv.Atoi(s.frameRate())
+		return float64(rate)
+	}
+	return float64(num) / float64(den)
+}
+
+// sampleAspectRatio returns the pixel aspect ratio as "W:H", defaulting to 1:1
+func (s *probeStream) sampleAspectRatio() string {
+	num, den, ok := parseRatio(s.SampleAspectRatio, ":")
+	if !ok || num == 0 {
+		return "1:1"
+	}
+	g := gcd(num, den)
+	return fmt.Sprintf("%d:%d", num/g, den/g)
+}
+
+// pictureAspectRatio returns the display aspect ratio as "W:H"
+func (s *probeStream) pictureAspectRatio() string {
+	if num, den, ok := parseRatio(s.DisplayAspectRatio, ":"); ok && num > 0 {
+		g := gcd(num, den)
+		return fmt.Sprintf("%d:%d", num/g, den/g)
+	}
+
+	if s.Width == 0 || s.Height == 0 {
+		return ""
+	}
+	sarNum, sarDen, ok := parseRatio(s.SampleAspectRatio, ":")
+	if !ok || sarNum == 0 {
+		sarNum, sarDen = 1, 1
+	}
+	num, den := s.Width*sarNum, s.Height*sarDen
+	g := gcd(num, den)
+	return fmt.Sprintf("%d:%d", num/g, den/g)
+}
+
+// sampleRate returns the audio sample rate in Hz (0 if unknown)
+func (s *probeStream) sampleRate() int {
+	rate, _ := strconv.Atoi(s.SampleRate)
+	return rate
+}
+
+// language returns the stream's ISO 639 language tag, if known
+func (s *probeStream) language() string {
+	lang := s.Tags["language"]
+	if lang == "und" {
+		return ""
+	}
+	return lang
+}
+
+// codecString returns the RFC 6381 codecs value for the stream (e.g. avc1.64001F)
+func (s *probeStream) codecString() string {
+	switch s.CodecName {
+	case "h264":
+		profileIdc, constraints := avcProfile(s.Profile)
+		level := s.Level
+		if level <= 0 {
+			level = 40
+		}
+		return fmt.Sprintf("avc1.%02X%02X%02X", profileIdc, constraints, level)
+	case "hevc":
+		profileIdc, compat := 1, 6
+		if strings.Contains(s.Profile, "10") {
+			profileIdc, compat = 2, 4
+		}
+		level := s.Level
+		if level <= 0 {
+			level = 120
+		}
+		return fmt.Sprintf("hvc1.%d.%d.L%d.B0", profileIdc, compat, level)
+	case "vp9":
+		return "vp09.00.40.08"
+	case "av1":
+		return "av01.0.08M.08"
+	case "aac":
+		switch s.Profile {
+		case "HE-AAC":
+			return "mp4a.40.5"
+		case "HE-AACv2":
+			return "mp4a.40.29"
+		default:
+			return "mp4a.40.2"
+		}
+	case "opus":
+		return "opus"
+	case "ac3":
+		return "ac-3"
+	case "eac3":
+		return "ec-3"
+	default:
+		return s.CodecName
+	}
+}
+
+// avcProfile maps an ffprobe H.264 profile name to profile_idc and constraint flags
+func avcProfile(profile string) (int, int) {
+	switch profile {
+	case "Constrained Baseline":
+		return 66, 0xC0
+	case "Baseline":
+		return 66, 0x00
+	case "Main":
+		return 77, 0x00
+	case "Extended":
+		return 88, 0x00
+	case "High 10", "High 10 Intra":
+		return 110, 0x00
+	case "High 4:2:2", "High 4:2:2 Intra":
+		return 122, 0x00
+	case "High 4:4:4 Predictive", "High 4:4:4 Intra":
+		return 244, 0x00
+	default:
+		return 100, 0x00
+	}
+}
+
+// parseRatio parses "a<sep>b" into two positive integers
+func parseRatio(value, sep string) (int, int, bool) {
+	a, b, ok := strings.Cut(value, sep)
+	if !ok {
+		return 0, 0, false
+	}
+	num, err := strconv.Atoi(a)
+	if err != nil || num < 0 {
+		return 0, 0, false
+	}
+	den, err := strconv.Atoi(b)
+	if err != nil || den <= 0 {
+		return 0, 0, false
+	}
+	return num, den, true
+}
+
+// gcd returns the greatest common divisor of a and b
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	if a == 0 {
+		return 1
+	}
+	return a
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+)
+
+// Name of the profile used when a job does not ask for one
+const defaultProfileName = "default"
+
+// EncodingProfile is a named set of encoding settings selectable per job
+type EncodingProfile struct {
+	Name           string       `json:"name"`
+	Description    string       `json:"description,omitempty"`
+	VideoCodec     string       `json:"video_codec"`   // h264 or hevc
+	Preset         string       `json:"preset"`        // encoder speed preset
+	VideoProfile   string       `json:"video_profile"` // e.g. high, main
+	GOPSeconds     int          `json:"gop_seconds"`
+	SegmentSeconds int          `json:"segment_seconds"`
+	AudioCodec     string       `json:"audio_codec"` // aac
+	AudioBitrate   string       `json:"audio_bitrate"`
+	AudioChannels  int          `json:"audio_channels"`
+	Ladder         []LadderRung `json:"ladder"`
+}
+
+// LadderRung is one rendition in a profile's bitrate ladder
+type LadderRung struct {
+	Height       int    `json:"height"`
+	VideoBitrate string `json:"video_bitrate"`
+}
+
+// profilesFile is the layout of the profiles config file
+type profilesFile struct {
+	Profiles []EncodingProfile `json:"profiles"`
+}
+
+// The shipped profiles.json, compiled in and used when no config file is present
+//
+//go:embed profiles.json
+var builtinProfilesJSON []byte
+
+// Loaded profiles by name; replaced by the config file on startup
+var encodingProfiles map[string]EncodingProfile
+
+// loadProfiles reads profiles from a JSON config file. A missing file keeps the
+// built-in profiles; an invalid one is an error.
+func loadProfiles(path string) (map[string]EncodingProfile, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Printf("No encoding profiles file at %s, using built-in profiles", path)
+		return parseProfiles(builtinProfilesJSON)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profiles file: %w", err)
+	}
+
+	profiles, err := parseProfiles(data)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Loaded %d encoding profiles from %s", len(profiles), path)
+	return profiles, nil
+}
+
+// parseProfiles parses and validates the contents of a profiles config file
+func parseProfiles(data []byte) (map[string]EncodingProfile, error) {
+	var file profilesFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid profiles file: %w", err)
+	}
+
+	profiles := make(map[string]EncodingProfile, len(file.Profiles))
+	for _, p := range file.Profiles {
+		p = p.withDefaults()
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("invalid profile %q: %w", p.Name, err)
+		}
+		if _, exists := profiles[p.Name]; exists {
+			return nil, fmt.Errorf("duplicate profile %q", p.Name)
+		}
+		profiles[p.Name] = p
+	}
+
+	if _, exists := profiles[defaultProfileName]; !exists {
+		return nil, fmt.Errorf("profiles file must define a %q profile", defaultProfileName)
+	}
+	return profiles, nil
+}
+
+// withDefaults fills in optional settings left empty in the config file
+func (p EncodingProfile) withDefaults() EncodingProfile {
+	if p.VideoCodec == "" {
+		p.VideoCodec = "h264"
+	}
+	if p.Preset == "" {
+		p.Preset = "medium"
+	}
+	if p.VideoProfile == "" {
+		if p.VideoCodec == "hevc" {
+			p.VideoProfile = "main"
+		} else {
+			p.VideoProfile = "high"
+		}
+	}
+	if p.GOPSeconds == 0 {
+		p.GOPSeconds = 2
+	}
+	if p.SegmentSeconds == 0 {
+		p.SegmentSeconds = 3 * p.GOPSeconds
+	}
+	if p.AudioCodec == "" {
+		p.AudioCodec = "aac"
+	}
+	if p.AudioBitrate == "" {
+		p.AudioBitrate = "128k"
+	}
+	if p.AudioChannels == 0 {
+		p.AudioChannels = 2
+	}
+	sort.Slice(p.Ladder, func(i, j int) bool {
+		return p.Ladder[i].Height < p.Ladder[j].Height
+	})
+	return p
+}
+
+// validate checks that a profile can be turned into ffmpeg arguments
+func (p EncodingProfile) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if _, ok := videoEncoders[p.VideoCodec]; !ok {
+		return fmt.Errorf("unsupported video codec %q", p.VideoCodec)
+	}
+	if p.AudioCodec != "aac" {
+		return fmt.Errorf("unsupported audio codec %q", p.AudioCodec)
+	}
+	if p.GOPSeconds < 1 {
+		return fmt.Errorf("gop_seconds must be positive")
+	}
+	if p.SegmentSeconds < p.GOPSeconds || p.SegmentSeconds%p.GOPSeconds != 0 {
+		return fmt.Errorf("segment_seconds must be a positive multiple of gop_seconds")
+	}
+	if p.AudioChannels < 1 {
+		return fmt.Errorf("audio_channels must be positive")
+	}
+	if bitrateToBps(p.AudioBitrate) <= 0 {
+		return fmt.Errorf("invalid audio bitrate %q", p.AudioBitrate)
+	}
+	if len(p.Ladder) == 0 {
+		return fmt.Errorf("ladder must have at least one rendition")
+	}
+	for _, rung := range p.Ladder {
+		if rung.Height <= 0 || rung.Height%2 != 0 {
+			return fmt.Errorf("rendition height %d must be a positive even number", rung.Height)
+		}
+		if bitrateToBps(rung.VideoBitrate) <= 0 {
+			return fmt.Errorf("invalid video bitrate %q for %dp", rung.VideoBitrate, rung.Height)
+		}
+	}
+	return nil
+}
+
+// videoEncoders maps profile codec names to ffmpeg encoders
+var videoEncoders = map[string]string{
+	"h264": "libx264",
+	"hevc": "libx265",
+}
+
+// videoCodecArgs returns the ffmpeg video encoder options for the profile
+func (p EncodingProfile) videoCodecArgs() []string {
+	args := []string{
+		"-c:v", videoEncoders[p.VideoCodec],
+		"-preset", p.Preset,
+		"-profile:v", p.VideoProfile,
+	}
+	if p.VideoCodec == "hevc" {
+		// hvc1 sample entries are required for HLS playback of HEVC in fMP4
+		args = append(args, "-tag:v", "hvc1")
+	}
+	return args
+}
+
+// fallbackCodecString is used in manifests when a rendition cannot be probed
+func (p EncodingProfile) fallbackCodecString() string {
+	if p.VideoCodec == "hevc" {
+		return "hvc1.1.6.L120.B0"
+	}
+	return "avc1.640028"
+}
+
+// getProfile returns the named profile, or the default profile for an empty name
+func getProfile(name string) (EncodingProfile, bool) {
+	if name == "" {
+		name = defaultProfileName
+	}
+	p, ok := encodingProfiles[name]
+	return p, ok
+}
+
+// listProfilesHandler returns the available encoding profiles
+func listProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	profiles := make([]EncodingProfile, 0, len(encodingProfiles))
+	for _, p := range encodingProfiles {
+		profiles = append(profiles, p)
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].Name < profiles[j].Name
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profiles)
+}
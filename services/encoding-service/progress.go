@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimum time between progress updates pushed to the job store
+const progressUpdateInterval = time.Second
+
+// progressTracker converts ffmpeg progress reports into overall job progress.
+// A job is split into a fixed number of equally weighted passes (one per
+// rendition and packaging format); each pass reports how far into the source
+// it has encoded.
+type progressTracker struct {
+	job         EncodingJob
+	duration    float64 // source duration in seconds
+	totalPasses int
+	pass        int // index of the pass currently running
+	lastUpdate  time.Time
+	mu          sync.Mutex
+}
+
+// newProgressTracker creates a tracker for a job made of totalPasses ffmpeg runs
+func newProgressTracker(job EncodingJob, duration float64, totalPasses int) *progressTracker {
+	if totalPasses < 1 {
+		totalPasses = 1
+	}
+	return &progressTracker{
+		job:         job,
+		duration:    duration,
+		totalPasses: totalPasses,
+	}
+}
+
+// startPass marks the beginning of the next ffmpeg run
+func (p *progressTracker) startPass(pass int, rendition string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pass = pass
+	p.job.CurrentRendition = rendition
+	p.publish(0, true)
+}
+
+// report records that the current pass has encoded outTime seconds of the source
+func (p *progressTracker) report(outTime float64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.publish(outTime, false)
+}
+
+// publish recomputes percent and ETA and pushes them through updateJob
+func (p *progressTracker) publish(outTime float64, force bool) {
+	passFraction := 0.0
+	if p.duration > 0 {
+		passFraction = math.Min(math.Max(outTime/p.duration, 0), 1)
+	}
+
+	fraction := (float64(p.pass) + passFraction) / float64(p.totalPasses)
+	percent := int(fraction * 100)
+	if percent > 99 {
+		// 100 is reserved for a completed job
+		percent = 99
+	}
+
+	if !force && (percent == p.job.Progress || time.Since(p.lastUpdate) < progressUpdateInterval) {
+		return
+	}
+
+	p.job.Progress = percent
+	p.job.ETASeconds = 0
+	if fraction > 0 && !p.job.StartedAt.IsZero() {
+		elapsed := time.Since(p.job.StartedAt).Seconds()
+		p.job.ETASeconds = int(math.Round(elapsed/fraction - elapsed))
+	}
+
+	p.lastUpdate = time.Now()
+	updateJob(p.job)
+}
+
+// runFFmpeg runs ffmpeg with a machine-readable progress channel on stdout,
+// calling onProgress with the encoded position in seconds. The process is
+// killed when ctx is cancelled and is subject to the configured resource
+// limits. It returns the diagnostic output written to stderr.
+func runFFmpeg(ctx context.Context, args []string, onProgress func(outTime float64)) ([]byte, error) {
+	fullArgs := append([]string{"-nostats", "-progress", "pipe:1"}, args...)
+	cmd := ffmpegCommand(ctx, fullArgs...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach to ffmpeg progress output: %w", err)
+	}
+
+	if err := startLimited(cmd); err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok || onProgress == nil {
+			continue
+		}
+		if outTime, ok := parseProgressTime(key, value); ok {
+			onProgress(outTime)
+		}
+	}
+
+	err = cmd.Wait()
+	return stderr.Bytes(), err
+}
+
+// parseProgressTime extracts the output position from an ffmpeg -progress line
+func parseProgressTime(key, value string) (float64, bool) {
+	switch key {
+	case "out_time_us", "out_time_ms":
+		// Both keys are reported in microseconds
+		us, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || us < 0 {
+			return 0, false
+		}
+		return float64(us) / 1e6, true
+	case "out_time":
+		return parseClockTime(value)
+	default:
+		return 0, false
+	}
+}
+
+// parseClockTime parses an HH:MM:SS.micro timestamp into seconds
+func parseClockTime(value string) (float64, bool) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return 0, false
+	}
+
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, false
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, false
+	}
+	seconds, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return float64(hours*3600+minutes*60) + seconds, true
+}
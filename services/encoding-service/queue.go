@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Maximum number of jobs waiting to be processed. Submissions beyond it are
+// rejected instead of blocking.
+var maxQueuedJobs = getEnvInt("MAX_QUEUED_JOBS", 100)
+
+// How long clients are asked to wait before resubmitting to a full queue
+const queueRetryAfter = 30 * time.Second
+
+// errQueueFull is returned when a job cannot be queued because the queue is at capacity
+var errQueueFull = errors.New("encoding queue is full")
+
+// queuedJob is a pending job as seen by the scheduler
+type queuedJob struct {
+	ID        string
+	Owner     string
+	Priority  int
+	CreatedAt time.Time
+	seq       uint64 // order of arrival, breaking ties between jobs created at once
+}
+
+// jobQueue holds the pending jobs that workers take jobs from. Adding a job
+// never blocks; taking one blocks until a job is available.
+//
+// Jobs are not processed in arrival order. The next job is the one with the
+// highest priority; among equal priorities the owner with the fewest running
+// jobs goes first, then the owner served longest ago, then the oldest job. A
+// bulk backfill by one owner therefore cannot starve another owner's upload.
+// Running jobs are never preempted.
+type jobQueue struct {
+	mu       sync.Mutex
+	nonEmpty *sync.Cond
+	jobs     []queuedJob
+	capacity int
+	seq      uint64
+
+	running map[string]int    // jobs taken by workers and not yet done, by owner
+	served  map[string]uint64 // when each owner last had a job taken, by pop count
+	pops    uint64
+}
+
+// pendingJobs is the queue of jobs waiting for a worker
+var pendingJobs = newJobQueue(maxQueuedJobs)
+
+func newJobQueue(capacity int) *jobQueue {
+	q := &jobQueue{
+		capacity: capacity,
+		running:  make(map[string]int),
+		served:   make(map[string]uint64),
+	}
+	q.nonEmpty = sync.NewCond(&q.mu)
+	return q
+}
+
+// tryPush adds a job to the queue, or returns errQueueFull
+func (q *jobQueue) tryPush(job EncodingJob) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.jobs) >= q.capacity {
+		return errQueueFull
+	}
+	q.add(job)
+	return nil
+}
+
+// push adds a job regardless of capacity. It is used for jobs restored at
+// startup, which were accepted before and must not be dropped.
+func (q *jobQueue) push(job EncodingJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.add(job)
+}
+
+// add appends a job; the caller holds q.mu
+func (q *jobQueue) add(job EncodingJob) {
+	q.seq++
+	q.jobs = append(q.jobs, queuedJob{
+		ID:        job.ID,
+		Owner:     job.Owner,
+		Priority:  job.Priority,
+		CreatedAt: job.CreatedAt,
+		seq:       q.seq,
+	})
+	q.nonEmpty.Signal()
+}
+
+// pop removes and returns the next job to process, waiting for one if the
+// queue is empty. The caller must call done once the job has finished. It
+// returns false instead if retire reports that the calling worker should stop.
+func (q *jobQueue) pop(retire func() bool) (queuedJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if retire() {
+			// Pass on the wakeup this worker may have consumed
+			if len(q.jobs) > 0 {
+				q.nonEmpty.Signal()
+			}
+			return queuedJob{}, false
+		}
+		if len(q.jobs) > 0 {
+			break
+		}
+		q.nonEmpty.Wait()
+	}
+
+	i := nextJob(q.jobs, q.running, q.served)
+	job := q.jobs[i]
+	q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+
+	q.pops++
+	q.running[job.Owner]++
+	q.served[job.Owner] = q.pops
+	return job, true
+}
+
+// wakeAll wakes every worker waiting for a job
+func (q *jobQueue) wakeAll() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.nonEmpty.Broadcast()
+}
+
+// done records that a job taken with pop is no longer running
+func (q *jobQueue) done(job queuedJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.running[job.Owner]--
+	if q.running[job.Owner] > 0 {
+		return
+	}
+	delete(q.running, job.Owner)
+
+	// Forget owners with nothing left, so the maps do not grow forever
+	for _, queued := range q.jobs {
+		if queued.Owner == job.Owner {
+			return
+		}
+	}
+	delete(q.served, job.Owner)
+}
+
+// remove drops a job that no longer needs processing, freeing its slot
+func (q *jobQueue) remove(jobID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, job := range q.jobs {
+		if job.ID == jobID {
+			q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+			return
+		}
+	}
+}
+
+// ordered returns the queued jobs in the order they would be taken if no
+// running job finished in the meantime
+func (q *jobQueue) ordered() []queuedJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	remaining := append([]queuedJob{}, q.jobs...)
+	running := make(map[string]int, len(q.running))
+	for owner, n := range q.running {
+		running[owner] = n
+	}
+	served := make(map[string]uint64, len(q.served))
+	for owner, n := range q.served {
+		served[owner] = n
+	}
+
+	// Simulate the pops; the queue is bounded, so this stays cheap
+	order := make([]queuedJob, 0, len(remaining))
+	pops := q.pops
+	for len(remaining) > 0 {
+		i := nextJob(remaining, running, served)
+		job := remaining[i]
+		remaining = append(remaining[:i], remaining[i+1:]...)
+
+		pops++
+		running[job.Owner]++
+		served[job.Owner] = pops
+		order = append(order, job)
+	}
+	return order
+}
+
+// positions returns the 1-based position of every queued job
+func (q *jobQueue) positions() map[string]int {
+	order := q.ordered()
+
+	positions := make(map[string]int, len(order))
+	for i, job := range order {
+		positions[job.ID] = i + 1
+	}
+	return positions
+}
+
+// nextJob returns the index of the job to run next: highest priority, then the
+// owner with the fewest running jobs, then the owner served longest ago, then
+// the oldest job
+func nextJob(jobs []queuedJob, running map[string]int, served map[string]uint64) int {
+	best := 0
+	for i := 1; i < len(jobs); i++ {
+		a, b := jobs[i], jobs[best]
+		switch {
+		case a.Priority != b.Priority:
+			if a.Priority > b.Priority {
+				best = i
+			}
+		case running[a.Owner] != running[b.Owner]:
+			if running[a.Owner] < running[b.Owner] {
+				best = i
+			}
+		case served[a.Owner] != served[b.Owner]:
+			if served[a.Owner] < served[b.Owner] {
+				best = i
+			}
+		case !a.CreatedAt.Equal(b.CreatedAt):
+			if a.CreatedAt.Before(b.CreatedAt) {
+				best = i
+			}
+		case a.seq < b.seq:
+			best = i
+		}
+	}
+	return best
+}
+
+// withQueuePosition returns a copy of a job with its current position in the
+// queue filled in, if it is waiting there
+func withQueuePosition(job EncodingJob, positions map[string]int) EncodingJob {
+	job.QueuePosition = 0
+	if job.Status == "pending" {
+		job.QueuePosition = positions[job.ID]
+	}
+	return job
+}
+
+// writeQueueFull tells a client the queue is saturated and when to try again
+func writeQueueFull(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(queueRetryAfter.Seconds())))
+	http.Error(w, "Encoding queue is full, try again later", http.StatusServiceUnavailable)
+}
+
+// queueStatus is the response of GET /queue
+type queueStatus struct {
+	Depth    int            `json:"depth"`
+	Capacity int            `json:"capacity"`
+	Jobs     []queueEntry   `json:"jobs"`    // queued jobs in the order they are expected to run
+	Running  map[string]int `json:"running"` // running jobs by owner; "" for jobs without one
+}
+
+// queueEntry describes a queued job in GET /queue
+type queueEntry struct {
+	ID       string `json:"id"`
+	Owner    string `json:"owner,omitempty"`
+	Priority int    `json:"priority"`
+}
+
+// queueHandler reports which jobs are waiting to be processed and in what order
+func queueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	order := pendingJobs.ordered()
+
+	status := queueStatus{
+		Depth:    len(order),
+		Capacity: pendingJobs.capacity,
+		Jobs:     make([]queueEntry, 0, len(order)),
+		Running:  make(map[string]int),
+	}
+	for _, job := range order {
+		status.Jobs = append(status.Jobs, queueEntry{ID: job.ID, Owner: job.Owner, Priority: job.Priority})
+	}
+
+	pendingJobs.mu.Lock()
+	for owner, n := range pendingJobs.running {
+		status.Running[owner] = n
+	}
+	pendingJobs.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// JobStore persists encoding jobs so they survive service restarts
+type JobStore interface {
+	// Load returns every job known to the store
+	Load() ([]EncodingJob, error)
+	// Save inserts or replaces a job
+	Save(job EncodingJob) error
+	// Delete removes a job from the store
+	Delete(id string) error
+	// Close flushes and releases the underlying storage
+	Close() error
+}
+
+// journalRecord is a single line in the job journal
+type journalRecord struct {
+	Op  string       `json:"op"` // put, delete
+	ID  string       `json:"id"`
+	Job *EncodingJob `json:"job,omitempty"`
+}
+
+// The journal is compacted once it holds this many records per live job, and
+// at least journalCompactMinRecords, as status changes rewrite jobs often
+const (
+	journalCompactRatio      = 4
+	journalCompactMinRecords = 1000
+)
+
+// journalStore is a JobStore backed by an append-only JSON lines file.
+// Mutations are queued and a background writer appends them, syncing once per
+// batch, so callers holding jobsMutex never wait for the disk. The journal is
+// compacted into a snapshot of the live jobs when it is opened and whenever
+// most of its records have been superseded.
+type journalStore struct {
+	path    string
+	file    *os.File // only used by the writer once opened
+	records int      // records in the journal file, only used by the writer
+
+	mu      sync.Mutex // guards the fields below
+	jobs    map[string]EncodingJob
+	queue   []journalRecord // records waiting to be written
+	closed  bool
+	wake    chan struct{}
+	stopped chan struct{}
+}
+
+// openJournalStore opens (or creates) the journal at path and replays it
+func openJournalStore(path string) (*journalStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create job store directory: %w", err)
+	}
+
+	s := &journalStore{
+		path:    path,
+		jobs:    make(map[string]EncodingJob),
+		wake:    make(chan struct{}, 1),
+		stopped: make(chan struct{}),
+	}
+
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+
+	if err := s.compact(s.sortedJobs()); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open job journal: %w", err)
+	}
+	s.file = f
+
+	go s.writer()
+	return s, nil
+}
+
+// replay rebuilds the in-memory job set from the journal on disk
+func (s *journalStore) replay() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open job journal: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		s.records++
+		var rec journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// A torn write at the tail is expected after a crash; keep what we have
+			log.Printf("Ignoring corrupt job journal entry at line %d: %v", line, err)
+			continue
+		}
+
+		switch rec.Op {
+		case "put":
+			if rec.Job != nil {
+				s.jobs[rec.Job.ID] = *rec.Job
+			}
+		case "delete":
+			delete(s.jobs, rec.ID)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// compact rewrites the journal so it only contains the given live jobs
+func (s *journalStore) compact(jobs []EncodingJob) error {
+	tmpPath := s.path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create job journal snapshot: %w", err)
+	}
+
+	w := bufio.NewWriter(f)
+	for _, job := range jobs {
+		job := job
+		if err := writeRecord(w, journalRecord{Op: "put", ID: job.ID, Job: &job}); err != nil {
+			f.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write job journal snapshot: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to sync job journal snapshot: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to close job journal snapshot: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("failed to replace job journal: %w", err)
+	}
+
+	s.records = len(jobs)
+	return nil
+}
+
+// compactIfNeeded compacts the journal once most of its records are superseded
+// and reopens it for appending. Records queued meanwhile are already part of
+// the snapshot; appending them again afterwards is harmless.
+func (s *journalStore) compactIfNeeded() error {
+	s.mu.Lock()
+	live := len(s.jobs)
+	s.mu.Unlock()
+	if s.records < journalCompactMinRecords || s.records < journalCompactRatio*live {
+		return nil
+	}
+
+	s.mu.Lock()
+	jobs := s.sortedJobs()
+	s.mu.Unlock()
+	if err := s.compact(jobs); err != nil {
+		return err
+	}
+
+	// The open file still refers to the journal that was replaced
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to reopen job journal: %w", err)
+	}
+	s.file.Close()
+	s.file = f
+	return nil
+}
+
+// sortedJobs returns the live jobs ordered by creation time. The caller holds
+// s.mu, or is opening the store.
+func (s *journalStore) sortedJobs() []EncodingJob {
+	jobs := make([]EncodingJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+	return jobs
+}
+
+// Load returns every job in the store ordered by creation time
+func (s *journalStore) Load() ([]EncodingJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sortedJobs(), nil
+}
+
+// Save queues a put record for the job
+func (s *journalStore) Save(job EncodingJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.enqueue(journalRecord{Op: "put", ID: job.ID, Job: &job}); err != nil {
+		return err
+	}
+	s.jobs[job.ID] = job
+	return nil
+}
+
+// Delete queues a delete record for the job
+func (s *journalStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.enqueue(journalRecord{Op: "delete", ID: id}); err != nil {
+		return err
+	}
+	delete(s.jobs, id)
+	return nil
+}
+
+// enqueue hands a record to the writer. The caller holds s.mu.
+func (s *journalStore) enqueue(rec journalRecord) error {
+	if s.closed {
+		return fmt.Errorf("job store is closed")
+	}
+
+	s.queue = append(s.queue, rec)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+		// The writer has been woken already and will pick this record up too
+	}
+	return nil
+}
+
+// Close writes the records still queued and closes the journal file
+func (s *journalStore) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	close(s.wake)
+	<-s.stopped
+	return s.file.Close()
+}
+
+// writer appends queued records until the store is closed, compacting the
+// journal when needed. Failures are logged; the jobs stay correct in memory.
+func (s *journalStore) writer() {
+	defer close(s.stopped)
+
+	for range s.wake {
+		s.flush()
+	}
+	// Records queued before Close
+	s.flush()
+}
+
+// flush appends every queued record and syncs the journal once
+func (s *journalStore) flush() {
+	s.mu.Lock()
+	batch := s.queue
+	s.queue = nil
+	s.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	if err := s.append(batch); err != nil {
+		log.Printf("Error persisting jobs: %v", err)
+		return
+	}
+	if err := s.compactIfNeeded(); err != nil {
+		log.Printf("Error compacting job journal: %v", err)
+	}
+}
+
+// append writes records to the journal and syncs them to disk
+func (s *journalStore) append(batch []journalRecord) error {
+	w := bufio.NewWriter(s.file)
+	for _, rec := range batch {
+		if err := writeRecord(w, rec); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write job journal: %w", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync job journal: %w", err)
+	}
+	s.records += len(batch)
+	return nil
+}
+
+// writeRecord encodes a record as a single JSON line
+func writeRecord(w *bufio.Writer, rec journalRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode job journal entry: %w", err)
+	}
+	data = append(data, '\n')
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("failed to write job journal: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Events sent when a source file's jobs are suspended or resumed
+const (
+	eventJobSuspended = "job.suspended"
+	eventJobResumed   = "job.resumed"
+)
+
+// suspendSourceJobsHandler withdraws every job for a source file while the
+// catalog service holds the file in its trash. Queued jobs leave the queue,
+// running ones are stopped and wait to be resumed, and completed outputs are
+// no longer listed in /streams or served.
+func suspendSourceJobsHandler(w http.ResponseWriter, r *http.Request) {
+	setSourceJobsSuspended(w, r, true)
+}
+
+// resumeSourceJobsHandler undoes suspendSourceJobsHandler once the file is restored
+func resumeSourceJobsHandler(w http.ResponseWriter, r *http.Request) {
+	setSourceJobsSuspended(w, r, false)
+}
+
+func setSourceJobsSuspended(w http.ResponseWriter, r *http.Request, suspended bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sourceFile := r.URL.Query().Get("source_file")
+	if sourceFile == "" {
+		http.Error(w, "source_file is required", http.StatusBadRequest)
+		return
+	}
+
+	changed := 0
+	jobsMutex.Lock()
+	for _, jobs := range []map[string]EncodingJob{activeJobs, completedJobs, failedJobs} {
+		for id, job := range jobs {
+			if job.SourceFile != sourceFile || job.Suspended == suspended {
+				continue
+			}
+
+			job.Suspended = suspended
+			if job.Status == "pending" {
+				if suspended {
+					pendingJobs.remove(id)
+				} else {
+					// Jobs waiting for an automatic retry are queued right away
+					job.NextRetryAt = nil
+					pendingJobs.push(job)
+				}
+			}
+			if cancel, running := runningJobs[id]; running && suspended {
+				// The worker puts the job back to pending once ffmpeg exits
+				cancel()
+			}
+
+			jobs[id] = job
+			saveJob(job)
+			if suspended {
+				publishJobEvent(eventJobSuspended, job)
+			} else {
+				publishJobEvent(eventJobResumed, job)
+				if job.Status == "completed" {
+					events.publish(eventStreamPublished, newStream(job))
+				}
+			}
+			changed++
+		}
+	}
+	jobsMutex.Unlock()
+
+	if suspended {
+		log.Printf("Suspended %d jobs for %s", changed, sourceFile)
+	} else {
+		log.Printf("Resumed %d jobs for %s", changed, sourceFile)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// jobSuspended reports whether a job is suspended, so its outputs are withheld
+func jobSuspended(jobID string) bool {
+	jobsMutex.RLock()
+	defer jobsMutex.RUnlock()
+
+	for _, jobs := range []map[string]EncodingJob{activeJobs, completedJobs, failedJobs} {
+		if job, exists := jobs[jobID]; exists {
+			return job.Suspended
+		}
+	}
+	return false
+}
+
+// hideSuspendedOutputs serves a directory of per-job outputs, whose paths start
+// with the job ID, answering 404 for jobs that are suspended
+func hideSuspendedOutputs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Clean the path as the file server does, so "./" or ".." cannot hide the job ID
+		jobID, _, _ := strings.Cut(strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/"), "/")
+		if jobSuspended(jobID) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
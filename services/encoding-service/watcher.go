@@ -0,0 +1,360 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Settings for picking up new files in the media directory
+var (
+	// How long a file's size must stay unchanged before it is encoded, unless
+	// it was seen being closed after writing or moved into place
+	fileStableInterval = getEnvDuration("FILE_STABLE_INTERVAL", 5*time.Second)
+
+	// How often the media directory is rescanned when inotify is not used
+	watchPollInterval = getEnvDuration("WATCH_POLL_INTERVAL", 10*time.Second)
+
+	// "poll" skips inotify, e.g. for network filesystems that never deliver events
+	watchMode = getEnv("WATCH_MODE", "auto")
+)
+
+// How often files still being written are checked for stability
+const stabilityCheckInterval = time.Second
+
+// The upload service marks an upload it is about to submit with a hidden
+// ".<name>.submitting" file next to it. Claims older than submitClaimTimeout
+// were left by an upload service that stopped before submitting.
+const (
+	submitClaimSuffix  = ".submitting"
+	submitClaimTimeout = 5 * time.Minute
+)
+
+// errSubmitPending means the upload service is still submitting a file itself
+var errSubmitPending = errors.New("upload is being submitted")
+
+// fileEvent is a change in the media directory reported by a native watcher
+type fileEvent struct {
+	Path   string // relative to mediaDir
+	Closed bool   // the file was closed after writing or moved into place, so it is complete
+	Rescan bool   // events may have been missed, so the whole directory must be rescanned
+}
+
+// pendingFile is a file that has been seen but may still be being written
+type pendingFile struct {
+	size      int64
+	modTime   time.Time
+	changedAt time.Time
+	deferred  bool // complete, but waiting for room in the queue or for the upload service
+}
+
+// pendingFiles holds files waiting to become stable, keyed by path relative to
+// mediaDir. Only used by the watcher goroutine.
+var pendingFiles = make(map[string]pendingFile)
+
+// watchForNewFiles monitors the media directory for new files and automatically
+// creates encoding jobs once they are complete. It uses inotify where available
+// and falls back to rescanning the directory periodically.
+func watchForNewFiles() {
+	var events <-chan fileEvent
+	if watchMode != "poll" {
+		var err error
+		if events, err = watchMediaEvents(mediaDir); err != nil {
+			log.Printf("Warning: Could not watch media directory, polling every %s instead: %v", watchPollInterval, err)
+		}
+	}
+
+	// Pick up files that arrived while the service was not running. Events
+	// are already being collected, so nothing is missed in between.
+	processExistingFiles()
+
+	if events == nil {
+		pollForNewFiles()
+		return
+	}
+	log.Printf("Watching media directory for new files")
+
+	ticker := time.NewTicker(stabilityCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				log.Printf("Warning: Media directory watcher stopped, polling every %s instead", watchPollInterval)
+				pollForNewFiles()
+				return
+			}
+			handleFileEvent(event)
+		case <-ticker.C:
+			checkPendingFiles()
+		}
+	}
+}
+
+// pollForNewFiles rescans the media directory every watchPollInterval
+func pollForNewFiles() {
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		processExistingFiles()
+	}
+}
+
+// handleFileEvent reacts to a single change reported by the native watcher
+func handleFileEvent(event fileEvent) {
+	switch {
+	case event.Rescan:
+		processExistingFiles()
+	case !isCandidateFile(event.Path):
+		return
+	case event.Closed:
+		if info, err := os.Stat(filepath.Join(mediaDir, event.Path)); err == nil && info.Mode().IsRegular() {
+			enqueueFile(event.Path, info)
+		}
+	default:
+		// Still being written; checkPendingFiles enqueues it once it stops changing
+		if _, ok := pendingFiles[event.Path]; !ok {
+			pendingFiles[event.Path] = pendingFile{size: -1}
+		}
+	}
+}
+
+// checkPendingFiles enqueues pending files that have stopped changing
+func checkPendingFiles() {
+	for relPath := range pendingFiles {
+		info, err := os.Stat(filepath.Join(mediaDir, relPath))
+		if err != nil || !info.Mode().IsRegular() {
+			delete(pendingFiles, relPath)
+			continue
+		}
+		if isFileStable(relPath, info) {
+			enqueueFile(relPath, info)
+		}
+	}
+}
+
+// isFileStable records a pending file's size and reports whether it has not changed for
+// fileStableInterval. Files seen for the first time count as unchanged since
+// their modification time, so files that were already complete are not delayed.
+func isFileStable(relPath string, info fs.FileInfo) bool {
+	now := time.Now()
+
+	changedAt := info.ModTime()
+	if prev, seen := pendingFiles[relPath]; seen {
+		changedAt = prev.changedAt
+		if prev.size != info.Size() || !prev.modTime.Equal(info.ModTime()) {
+			changedAt = now
+		}
+	}
+	if changedAt.After(now) {
+		changedAt = now
+	}
+
+	if now.Sub(changedAt) >= fileStableInterval {
+		return true
+	}
+
+	pendingFiles[relPath] = pendingFile{
+		size:      info.Size(),
+		modTime:   info.ModTime(),
+		changedAt: changedAt,
+	}
+	return false
+}
+
+// isCandidateFile reports whether a file in the media directory should be
+// encoded: a video that is not hidden and not a temporary or partial file
+func isCandidateFile(relPath string) bool {
+	for _, elem := range strings.Split(filepath.ToSlash(relPath), "/") {
+		if strings.HasPrefix(elem, ".") {
+			return false
+		}
+	}
+	return isVideoFile(relPath) && !isTempFileName(filepath.Base(relPath))
+}
+
+// tempNameParts are name components that mark files still being written, e.g.
+// "clip.part.mp4" or "clip.tmp.mov"
+var tempNameParts = map[string]bool{
+	"part":       true,
+	"partial":    true,
+	"tmp":        true,
+	"temp":       true,
+	"crdownload": true,
+	"filepart":   true,
+	"swp":        true,
+}
+
+// isTempFileName reports whether a file name follows a temporary file naming
+// convention. The upload service writes to hidden ".<name>.part" files.
+func isTempFileName(name string) bool {
+	if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "~") || strings.HasSuffix(name, "~") {
+		return true
+	}
+	for _, part := range strings.Split(strings.ToLower(name), ".")[1:] {
+		if tempNameParts[part] {
+			return true
+		}
+	}
+	return false
+}
+
+// processExistingFiles scans the media directory for complete files without a
+// job and creates jobs for them. Files still being written are left pending.
+func processExistingFiles() {
+	// Collect all source files that already have a job
+	processed := make(map[string]bool)
+	jobsMutex.RLock()
+	for _, jobs := range []map[string]EncodingJob{activeJobs, completedJobs, failedJobs} {
+		for _, job := range jobs {
+			processed[job.SourceFile] = true
+		}
+	}
+	jobsMutex.RUnlock()
+
+	err := filepath.WalkDir(mediaDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Skip directories, and hidden ones such as the hash index entirely
+		if d.IsDir() {
+			if path != mediaDir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Get the relative path to use as the source file ID
+		relPath, err := filepath.Rel(mediaDir, path)
+		if err != nil {
+			return err
+		}
+
+		// Only process complete video files without a job
+		if !d.Type().IsRegular() || !isCandidateFile(relPath) || processed[relPath] {
+			return nil
+		}
+		info, err := d.Info()
+		if os.IsNotExist(err) {
+			// Removed while walking
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if isFileStable(relPath, info) {
+			enqueueFile(relPath, info)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.Printf("Error scanning media directory: %v", err)
+	}
+}
+
+// enqueueFile creates a job for a complete file. While the queue is full or
+// the upload service is submitting the file, it is kept pending and retried,
+// instead of blocking the watcher.
+func enqueueFile(relPath string, info fs.FileInfo) {
+	err := createJobForFile(relPath)
+	if err != errQueueFull && err != errSubmitPending {
+		delete(pendingFiles, relPath)
+		return
+	}
+
+	if err == errQueueFull && !pendingFiles[relPath].deferred {
+		log.Printf("Encoding queue is full, deferring %s", relPath)
+	}
+	// A zero changedAt counts as stable, so the next check retries it
+	pendingFiles[relPath] = pendingFile{
+		size:     info.Size(),
+		modTime:  info.ModTime(),
+		deferred: true,
+	}
+}
+
+// createJobForFile creates an encoding job for a complete source file, unless
+// it already has one or is a duplicate of another file. It returns errQueueFull
+// if the job could not be queued, and errSubmitPending while the upload service
+// is submitting the file with its own profile, owner and priority.
+func createJobForFile(relPath string) error {
+	// Uploads are usually submitted by the upload service already; skip hashing them again
+	jobsMutex.RLock()
+	submitted := hasJobForSource(relPath)
+	jobsMutex.RUnlock()
+	if submitted {
+		return nil
+	}
+	if submitClaimed(relPath) {
+		return errSubmitPending
+	}
+
+	// Index the file's content so identical uploads are only encoded once
+	owner, err := sourceOwner(relPath)
+	if err != nil {
+		log.Printf("Warning: Could not index %s: %v", relPath, err)
+		owner = relPath
+	}
+
+	// Skip duplicates; the file with the same content is encoded instead
+	if owner != relPath {
+		return nil
+	}
+
+	// Create a new job
+	jobID := fmt.Sprintf("job_%d", time.Now().UnixNano())
+	job := EncodingJob{
+		ID:         jobID,
+		SourceFile: relPath,
+		Profile:    defaultProfileName,
+		Priority:   sourcePriority(relPath),
+		Status:     "pending",
+		Progress:   0,
+		CreatedAt:  time.Now(),
+	}
+
+	// Add to queue, unless the file has been processed or submitted already
+	jobsMutex.Lock()
+	if hasJobForSource(relPath) {
+		jobsMutex.Unlock()
+		return nil
+	}
+	if err := pendingJobs.tryPush(job); err != nil {
+		jobsMutex.Unlock()
+		return err
+	}
+	activeJobs[jobID] = job
+	saveJob(job)
+	publishJobEvent(eventJobCreated, job)
+	jobsMutex.Unlock()
+
+	log.Printf("New encoding job created for file: %s", relPath)
+	return nil
+}
+
+// submitClaimed reports whether the upload service has claimed a file it is
+// about to submit. Stale claims are removed.
+func submitClaimed(relPath string) bool {
+	claimPath := filepath.Join(mediaDir, filepath.Dir(relPath), "."+filepath.Base(relPath)+submitClaimSuffix)
+	info, err := os.Stat(claimPath)
+	if err != nil {
+		return false
+	}
+	if time.Since(info.ModTime()) < submitClaimTimeout {
+		return true
+	}
+
+	log.Printf("Ignoring stale upload claim for %s", relPath)
+	os.Remove(claimPath)
+	return false
+}
@@ -0,0 +1,135 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Events that can make a new source file available
+const inotifyMask = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO
+
+// inotifyWatcher watches a directory tree with inotify
+type inotifyWatcher struct {
+	fd   int
+	root string
+	dirs map[int32]string // watched directories relative to root, by watch descriptor
+}
+
+// watchMediaEvents reports changes to files under root, which is watched
+// recursively except for hidden directories
+func watchMediaEvents(root string) (<-chan fileEvent, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize inotify: %w", err)
+	}
+
+	w := &inotifyWatcher{fd: fd, root: root, dirs: make(map[int32]string)}
+	if err := w.addTree("."); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	events := make(chan fileEvent, 64)
+	go w.run(events)
+	return events, nil
+}
+
+// addTree watches dir and every directory below it that is not hidden
+func (w *inotifyWatcher) addTree(dir string) error {
+	return filepath.WalkDir(filepath.Join(w.root, dir), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(w.root, path)
+		if err != nil {
+			return err
+		}
+		if rel != "." && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, path, inotifyMask|syscall.IN_ONLYDIR)
+		if err != nil {
+			return fmt.Errorf("failed to watch %s: %w", path, err)
+		}
+		w.dirs[int32(wd)] = rel
+		return nil
+	})
+}
+
+// run reads inotify events until the descriptor fails, then closes events
+func (w *inotifyWatcher) run(events chan<- fileEvent) {
+	defer close(events)
+	defer syscall.Close(w.fd)
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || n <= 0 {
+			log.Printf("Error reading inotify events: %v", err)
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			offset = start + int(raw.Len)
+			if offset > n {
+				break
+			}
+
+			name := strings.TrimRight(string(buf[start:offset]), "\x00")
+			w.handle(raw.Wd, raw.Mask, name, events)
+		}
+	}
+}
+
+// handle translates a single inotify event
+func (w *inotifyWatcher) handle(wd int32, mask uint32, name string, events chan<- fileEvent) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		events <- fileEvent{Rescan: true}
+		return
+	}
+	if mask&syscall.IN_IGNORED != 0 {
+		// The directory was removed
+		delete(w.dirs, wd)
+		return
+	}
+
+	dir, ok := w.dirs[wd]
+	if !ok || name == "" {
+		return
+	}
+	path := filepath.Join(dir, name)
+
+	if mask&syscall.IN_ISDIR != 0 {
+		if mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) == 0 || strings.HasPrefix(name, ".") {
+			return
+		}
+		if err := w.addTree(path); err != nil {
+			log.Printf("Warning: Could not watch new directory %s: %v", path, err)
+		}
+		// Files may have been added before the directory was watched
+		events <- fileEvent{Rescan: true}
+		return
+	}
+
+	events <- fileEvent{
+		Path:   path,
+		Closed: mask&(syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO) != 0,
+	}
+}
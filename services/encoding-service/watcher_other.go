@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// watchMediaEvents is only implemented with inotify; elsewhere the media
+// directory is polled
+func watchMediaEvents(root string) (<-chan fileEvent, error) {
+	return nil, errors.New("native file watching is only supported on Linux")
+}
@@ -0,0 +1,649 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Settings for outbound webhooks
+var (
+	webhooksPath          = getEnv("WEBHOOKS_PATH", "./data/webhooks.json") // holds the signing secrets, so never below encodedDir
+	webhookDeliveriesPath = getEnv("WEBHOOK_DELIVERIES_PATH", "./data/webhook-deliveries.json")
+	webhookAttempts       = getEnvInt("WEBHOOK_ATTEMPTS", 5)
+	webhookBackoff        = getEnvDuration("WEBHOOK_BACKOFF", 2*time.Second) // doubles after every failed attempt
+
+	// Connections are checked after DNS resolution, so neither a redirect nor a
+	// changed DNS record lets a webhook reach a disallowed address
+	webhookClient = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{Timeout: 5 * time.Second, Control: checkWebhookDial}).DialContext,
+		},
+	}
+)
+
+// errWebhookAddress is returned for webhook URLs that reach this host or a
+// link-local address, such as a cloud metadata endpoint
+var errWebhookAddress = errors.New("webhook address is not allowed")
+
+// Number of deliveries remembered per webhook
+const webhookLogSize = 100
+
+// Events webhooks can subscribe to, and the ones they get when they do not choose
+var (
+	webhookEventTypes = []string{
+		eventJobCreated,
+		eventJobStarted,
+		eventJobCompleted,
+		eventJobFailed,
+		eventJobCancelled,
+		eventJobRetried,
+	}
+	defaultWebhookEvents = []string{eventJobCompleted, eventJobFailed}
+)
+
+// Webhook is a subscription to job events delivered to a URL
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"` // only returned when the webhook is created
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// webhookPayload is the JSON body POSTed to a webhook URL
+type webhookPayload struct {
+	DeliveryID string      `json:"delivery_id"`
+	Event      string      `json:"event"`
+	Timestamp  time.Time   `json:"timestamp"`
+	Job        EncodingJob `json:"job"`
+}
+
+// WebhookDelivery records the attempts to deliver one event to a webhook
+type WebhookDelivery struct {
+	ID            string     `json:"id"`
+	Event         string     `json:"event"`
+	JobID         string     `json:"job_id"`
+	Status        string     `json:"status"` // pending, succeeded, failed
+	Attempts      int        `json:"attempts"`
+	ResponseCode  int        `json:"response_code,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	LastAttemptAt *time.Time `json:"last_attempt_at,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+}
+
+// webhookRegistry holds the webhook subscriptions and their recent deliveries
+type webhookRegistry struct {
+	mu         sync.Mutex
+	path       string
+	webhooks   map[string]Webhook
+	deliveries map[string][]*WebhookDelivery // by webhook ID, oldest first
+
+	// Where the delivery log is saved; a background goroutine writes it after
+	// every change, as deliveries are recorded while jobsMutex is held
+	deliveriesPath    string
+	deliveriesChanged chan struct{}
+}
+
+var webhooks = &webhookRegistry{
+	webhooks:   make(map[string]Webhook),
+	deliveries: make(map[string][]*WebhookDelivery),
+}
+
+// load reads the saved subscriptions from path, which later changes are saved to
+func (r *webhookRegistry) load(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.path = path
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read webhooks: %w", err)
+	}
+
+	var saved []Webhook
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("failed to parse webhooks: %w", err)
+	}
+	for _, webhook := range saved {
+		r.webhooks[webhook.ID] = webhook
+	}
+	return nil
+}
+
+// loadDeliveries reads the saved delivery log from path and starts saving it
+// there after every change. Deliveries that were still pending when the
+// service stopped are marked failed.
+func (r *webhookRegistry) loadDeliveries(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.deliveriesPath = path
+	r.deliveriesChanged = make(chan struct{}, 1)
+	go r.saveDeliveriesLoop()
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read webhook deliveries: %w", err)
+	}
+
+	var saved map[string][]*WebhookDelivery
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("failed to parse webhook deliveries: %w", err)
+	}
+	for webhookID, deliveries := range saved {
+		if _, exists := r.webhooks[webhookID]; !exists {
+			continue
+		}
+		for _, delivery := range deliveries {
+			if delivery.Status == "pending" {
+				delivery.Status = "failed"
+				delivery.Error = "interrupted by a restart of the encoding service"
+				delivery.NextAttemptAt = nil
+			}
+		}
+		r.deliveries[webhookID] = deliveries
+	}
+	return nil
+}
+
+// save writes every subscription to disk; the caller holds r.mu
+func (r *webhookRegistry) save() error {
+	data, err := json.MarshalIndent(r.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomically(r.path, data); err != nil {
+		return fmt.Errorf("failed to save webhooks: %w", err)
+	}
+	return nil
+}
+
+// deliveriesUpdated asks for the delivery log to be saved; the caller holds r.mu
+func (r *webhookRegistry) deliveriesUpdated() {
+	if r.deliveriesChanged == nil {
+		return
+	}
+	select {
+	case r.deliveriesChanged <- struct{}{}:
+	default:
+		// A save is already due and will include this change
+	}
+}
+
+// saveDeliveriesLoop saves the delivery log whenever it changes
+func (r *webhookRegistry) saveDeliveriesLoop() {
+	for range r.deliveriesChanged {
+		r.mu.Lock()
+		data, err := json.MarshalIndent(r.deliveries, "", "  ")
+		path := r.deliveriesPath
+		r.mu.Unlock()
+
+		if err == nil {
+			err = writeFileAtomically(path, data)
+		}
+		if err != nil {
+			log.Printf("Error saving webhook deliveries: %v", err)
+		}
+	}
+}
+
+// writeFileAtomically replaces the file at path with data, readable only by
+// the service, writing to a temporary file first so a crash never leaves a
+// truncated file
+func writeFileAtomically(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// sorted returns the subscriptions ordered by creation time; the caller holds r.mu
+func (r *webhookRegistry) sorted() []Webhook {
+	list := make([]Webhook, 0, len(r.webhooks))
+	for _, webhook := range r.webhooks {
+		list = append(list, webhook)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+// add stores a new subscription
+func (r *webhookRegistry) add(webhook Webhook) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.webhooks[webhook.ID] = webhook
+	if err := r.save(); err != nil {
+		delete(r.webhooks, webhook.ID)
+		return err
+	}
+	return nil
+}
+
+// remove deletes a subscription and its delivery log, reporting whether it existed
+func (r *webhookRegistry) remove(id string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	webhook, exists := r.webhooks[id]
+	if !exists {
+		return false, nil
+	}
+
+	delete(r.webhooks, id)
+	if err := r.save(); err != nil {
+		r.webhooks[id] = webhook
+		return true, err
+	}
+	delete(r.deliveries, id)
+	r.deliveriesUpdated()
+	return true, nil
+}
+
+// get returns a subscription by ID
+func (r *webhookRegistry) get(id string) (Webhook, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	webhook, exists := r.webhooks[id]
+	return webhook, exists
+}
+
+// dispatchWebhooks delivers a job event to every webhook subscribed to it. It
+// returns immediately; deliveries and their retries run in the background.
+func dispatchWebhooks(eventType string, job EncodingJob) {
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+
+	for _, webhook := range webhooks.webhooks {
+		if !containsString(webhook.Events, eventType) {
+			continue
+		}
+
+		delivery := &WebhookDelivery{
+			ID:        fmt.Sprintf("dlv_%d", time.Now().UnixNano()),
+			Event:     eventType,
+			JobID:     job.ID,
+			Status:    "pending",
+			CreatedAt: time.Now(),
+		}
+
+		recent := append(webhooks.deliveries[webhook.ID], delivery)
+		if len(recent) > webhookLogSize {
+			recent = recent[len(recent)-webhookLogSize:]
+		}
+		webhooks.deliveries[webhook.ID] = recent
+		webhooks.deliveriesUpdated()
+
+		go deliverWebhook(webhook, delivery, job)
+	}
+}
+
+// deliverWebhook POSTs an event to a webhook, retrying with exponential
+// backoff until it succeeds, fails permanently or webhookAttempts is reached
+func deliverWebhook(webhook Webhook, delivery *WebhookDelivery, job EncodingJob) {
+	body, err := json.Marshal(webhookPayload{
+		DeliveryID: delivery.ID,
+		Event:      delivery.Event,
+		Timestamp:  delivery.CreatedAt,
+		Job:        job,
+	})
+	if err != nil {
+		log.Printf("Error encoding webhook payload for job %s: %v", job.ID, err)
+		return
+	}
+
+	backoff := webhookBackoff
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		// Stop retrying for webhooks deleted in the meantime
+		if _, exists := webhooks.get(webhook.ID); !exists {
+			return
+		}
+
+		code, retryable, err := postWebhook(webhook, delivery, body)
+
+		webhooks.mu.Lock()
+		now := time.Now()
+		delivery.Attempts = attempt
+		delivery.LastAttemptAt = &now
+		delivery.ResponseCode = code
+		delivery.NextAttemptAt = nil
+		switch {
+		case err == nil:
+			delivery.Status = "succeeded"
+			delivery.Error = ""
+		case retryable && attempt < webhookAttempts:
+			delivery.Error = err.Error()
+			next := now.Add(backoff)
+			delivery.NextAttemptAt = &next
+		default:
+			delivery.Status = "failed"
+			delivery.Error = err.Error()
+		}
+		done := delivery.Status != "pending"
+		webhooks.deliveriesUpdated()
+		webhooks.mu.Unlock()
+
+		if done {
+			if err != nil {
+				log.Printf("Webhook %s delivery %s for job %s failed: %v", webhook.ID, delivery.ID, job.ID, err)
+			}
+			return
+		}
+
+		log.Printf("Webhook %s delivery %s failed (attempt %d/%d): %v", webhook.ID, delivery.ID, attempt, webhookAttempts, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// postWebhook sends a single signed delivery. It returns the response status
+// code, if any, and whether a failure is worth retrying.
+func postWebhook(webhook Webhook, delivery *WebhookDelivery, body []byte) (int, bool, error) {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "encoding-service-webhooks")
+	req.Header.Set("X-Webhook-Id", webhook.ID)
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Delivery", delivery.ID)
+	req.Header.Set("X-Webhook-Signature", signWebhookPayload(webhook.Secret, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, !errors.Is(err, errWebhookAddress), err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		err := fmt.Errorf("webhook returned %s", resp.Status)
+		// Client errors will not succeed on retry
+		retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+		return resp.StatusCode, retryable, err
+	}
+	return resp.StatusCode, false, nil
+}
+
+// signWebhookPayload returns the X-Webhook-Signature header for a body: the
+// hex HMAC-SHA256 of the body keyed with the webhook's secret
+func signWebhookPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// validateWebhookURL checks that a webhook URL is an absolute http or https URL
+// whose host does not resolve to a disallowed address
+func validateWebhookURL(target *url.URL) error {
+	if (target.Scheme != "http" && target.Scheme != "https") || target.Hostname() == "" {
+		return errors.New("URL must be an absolute http or https URL")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, target.Hostname())
+	if err != nil {
+		return fmt.Errorf("could not resolve %s", target.Hostname())
+	}
+	for _, addr := range addrs {
+		if !allowedWebhookIP(addr.IP) {
+			return fmt.Errorf("URL must not point to a loopback, link-local or multicast address (%s)", addr.IP)
+		}
+	}
+	return nil
+}
+
+// checkWebhookDial refuses webhook connections to disallowed addresses
+func checkWebhookDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !allowedWebhookIP(ip) {
+		return fmt.Errorf("%w: %s", errWebhookAddress, host)
+	}
+	return nil
+}
+
+// allowedWebhookIP reports whether webhooks may be delivered to ip: anything
+// but loopback, link-local, multicast and unspecified addresses
+func allowedWebhookIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// newWebhookSecret generates a random signing secret
+func newWebhookSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// webhooksHandler routes requests for the webhook collection
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listWebhooksHandler(w, r)
+	case http.MethodPost:
+		createWebhookHandler(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// webhookHandler routes requests for a single webhook
+func webhookHandler(w http.ResponseWriter, r *http.Request) {
+	// Extract webhook ID and optional action from URL path
+	webhookID, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/webhooks/"), "/")
+	if webhookID == "" {
+		http.Error(w, "Webhook ID is required", http.StatusBadRequest)
+		return
+	}
+
+	switch action {
+	case "":
+		switch r.Method {
+		case http.MethodGet:
+			getWebhookHandler(w, r, webhookID)
+		case http.MethodDelete:
+			deleteWebhookHandler(w, r, webhookID)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case "deliveries":
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		listDeliveriesHandler(w, r, webhookID)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// createWebhookHandler subscribes a URL to job events
+func createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+		Secret string   `json:"secret"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	target, err := url.Parse(request.URL)
+	if err != nil {
+		http.Error(w, "URL must be an absolute http or https URL", http.StatusBadRequest)
+		return
+	}
+	if err := validateWebhookURL(target); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	eventTypes := request.Events
+	if len(eventTypes) == 0 {
+		eventTypes = defaultWebhookEvents
+	}
+	for _, eventType := range eventTypes {
+		if !containsString(webhookEventTypes, eventType) {
+			http.Error(w, fmt.Sprintf("Unknown event %q, expected one of: %s", eventType, strings.Join(webhookEventTypes, ", ")), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Generate a secret unless the client chose one
+	secret := request.Secret
+	if secret == "" {
+		if secret, err = newWebhookSecret(); err != nil {
+			http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	webhook := Webhook{
+		ID:        fmt.Sprintf("whk_%d", time.Now().UnixNano()),
+		URL:       target.String(),
+		Events:    eventTypes,
+		Secret:    secret,
+		CreatedAt: time.Now(),
+	}
+
+	if err := webhooks.add(webhook); err != nil {
+		log.Printf("Error saving webhook: %v", err)
+		http.Error(w, "Failed to save webhook", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Webhook %s created for %s", webhook.ID, webhook.URL)
+
+	// The secret is only ever shown here
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(webhook)
+}
+
+// listWebhooksHandler returns every webhook, without secrets
+func listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	webhooks.mu.Lock()
+	list := webhooks.sorted()
+	webhooks.mu.Unlock()
+
+	for i := range list {
+		list[i].Secret = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// getWebhookHandler returns a single webhook, without its secret
+func getWebhookHandler(w http.ResponseWriter, r *http.Request, webhookID string) {
+	webhook, exists := webhooks.get(webhookID)
+	if !exists {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	webhook.Secret = ""
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webhook)
+}
+
+// deleteWebhookHandler unsubscribes a webhook; pending retries are abandoned
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request, webhookID string) {
+	exists, err := webhooks.remove(webhookID)
+	if !exists {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting webhook %s: %v", webhookID, err)
+		http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Webhook %s deleted", webhookID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listDeliveriesHandler returns the recent deliveries of a webhook, newest
+// first, optionally filtered by ?status=
+func listDeliveriesHandler(w http.ResponseWriter, r *http.Request, webhookID string) {
+	status := r.URL.Query().Get("status")
+
+	webhooks.mu.Lock()
+	if _, exists := webhooks.webhooks[webhookID]; !exists {
+		webhooks.mu.Unlock()
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	recent := webhooks.deliveries[webhookID]
+	deliveries := make([]WebhookDelivery, 0, len(recent))
+	for i := len(recent) - 1; i >= 0; i-- {
+		if status == "" || recent[i].Status == status {
+			deliveries = append(deliveries, *recent[i])
+		}
+	}
+	webhooks.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// Upper bound on the worker pool size
+const maxWorkers = 64
+
+// Number of jobs processed in parallel at startup
+var initialWorkers = getEnvInt("MAX_CONCURRENT_JOBS", 2)
+
+// workerPool tracks the workers that process queued jobs. It can be resized
+// while jobs run: new workers start right away, and surplus workers stop once
+// they finish their current job.
+type workerPool struct {
+	mu      sync.Mutex
+	size    int // target number of workers
+	workers int // running workers, including surplus ones about to stop
+}
+
+var pool = &workerPool{}
+
+// resize sets the target number of workers
+func (p *workerPool) resize(size int) {
+	p.mu.Lock()
+	p.size = size
+	for p.workers < p.size {
+		p.workers++
+		go worker()
+	}
+	p.mu.Unlock()
+
+	// Wake idle workers so surplus ones can stop
+	pendingJobs.wakeAll()
+}
+
+// retire reports whether the calling worker is surplus, counting it out if so
+func (p *workerPool) retire() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.workers > p.size {
+		p.workers--
+		return true
+	}
+	return false
+}
+
+// worker processes jobs from the queue until the pool shrinks
+func worker() {
+	for {
+		queued, ok := pendingJobs.pop(pool.retire)
+		if !ok {
+			return
+		}
+		runJob(queued.ID)
+		pendingJobs.done(queued)
+	}
+}
+
+// workersStatus is the response of GET and PUT /workers
+type workersStatus struct {
+	Size    int `json:"size"`    // target number of workers
+	Workers int `json:"workers"` // running workers, including ones finishing a job before stopping
+	Busy    int `json:"busy"`    // workers processing a job
+}
+
+// workersHandler reports or changes the size of the worker pool
+func workersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var request struct {
+			Size int `json:"size"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if request.Size < 1 || request.Size > maxWorkers {
+			http.Error(w, fmt.Sprintf("Size must be between 1 and %d", maxWorkers), http.StatusBadRequest)
+			return
+		}
+
+		pool.resize(request.Size)
+		log.Printf("Worker pool resized to %d", request.Size)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pool.mu.Lock()
+	status := workersStatus{Size: pool.size, Workers: pool.workers}
+	pool.mu.Unlock()
+
+	jobsMutex.RLock()
+	status.Busy = len(runningJobs)
+	jobsMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
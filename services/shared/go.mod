@@ -0,0 +1,3 @@
+module github.com/superlive/shared
+
+go 1.19
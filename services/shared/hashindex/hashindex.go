@@ -0,0 +1,130 @@
+// Package hashindex maps content hashes to the files stored in the media
+// directory, so identical uploads are stored and encoded only once. The index
+// lives in the media directory itself, where every service reaches it through
+// the shared volume.
+package hashindex
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Index is the hidden ".hashes" directory of a media directory. Each entry is
+// a file named after the SHA-256 whose content is the file ID, the file's path
+// relative to the media directory.
+type Index struct {
+	root string
+	dir  string
+}
+
+// New returns the index of the media directory root
+func New(root string) *Index {
+	return &Index{root: root, dir: filepath.Join(root, ".hashes")}
+}
+
+// Lookup returns the ID of the stored file with the given content hash.
+// Entries whose file has since been removed are dropped.
+func (ix *Index) Lookup(checksum string) (string, bool) {
+	entry := filepath.Join(ix.dir, checksum)
+	data, err := os.ReadFile(entry)
+	if err != nil {
+		return "", false
+	}
+
+	fileID := strings.TrimSpace(string(data))
+	if _, err := os.Stat(filepath.Join(ix.root, fileID)); err != nil {
+		os.Remove(entry)
+		return "", false
+	}
+	return fileID, true
+}
+
+// Claim records fileID as the owner of a content hash and returns the owner,
+// which is a different file ID if identical content was indexed first.
+// Entries are created with a hard link so the claim is atomic across processes.
+func (ix *Index) Claim(checksum, fileID string) (string, error) {
+	if err := os.MkdirAll(ix.dir, 0755); err != nil {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp(ix.dir, ".claim-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(fileID)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	entry := filepath.Join(ix.dir, checksum)
+	for attempt := 0; attempt < 2; attempt++ {
+		err := os.Link(tmp.Name(), entry)
+		if err == nil {
+			return fileID, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return "", err
+		}
+		if owner, ok := ix.Lookup(checksum); ok {
+			return owner, nil
+		}
+		// The entry was stale and Lookup removed it; try again
+	}
+	return "", fmt.Errorf("could not claim hash %s", checksum)
+}
+
+// Release removes the entry claiming a file's content, so later files with
+// the same content are stored anew rather than pointed at it. It returns the
+// released hash, or "" if the file had no entry.
+func (ix *Index) Release(fileID string) (string, error) {
+	entries, err := os.ReadDir(ix.dir)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// The index is keyed by hash, so finding a file's entry means reading them all
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(ix.dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil || strings.TrimSpace(string(data)) != fileID {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		return entry.Name(), nil
+	}
+	return "", nil
+}
+
+// HashFile returns the hex SHA-256 of a file's content
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,75 @@
+// Package safepath resolves client-supplied paths, such as file IDs taken from
+// URLs, inside the directory they refer to. Every service resolves paths it
+// gets from clients with it.
+package safepath
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrUnsafe is returned for client-supplied paths that could reach outside
+// the directory they are resolved in
+var ErrUnsafe = errors.New("unsafe path")
+
+// Resolve resolves a client-supplied relative path, such as a file ID taken
+// from a URL, to a path inside root. It rejects absolute paths, paths with ".."
+// or other dot-prefixed elements (which also keeps hidden files such as the
+// hash index out of reach), and paths that leave root through a symlink. The
+// path does not have to exist yet, but its existing part is resolved.
+func Resolve(root, name string) (string, error) {
+	if name == "" || strings.ContainsRune(name, 0) || isPathSeparator(rune(name[0])) || filepath.IsAbs(name) {
+		return "", ErrUnsafe
+	}
+	for _, elem := range strings.FieldsFunc(name, isPathSeparator) {
+		if strings.HasPrefix(elem, ".") {
+			return "", ErrUnsafe
+		}
+	}
+
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+
+	// Resolve symlinks in the longest existing prefix of the path
+	existing, rest := filepath.Join(root, filepath.FromSlash(name)), ""
+	var path string
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			path = filepath.Join(resolved, rest)
+			break
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		if _, err := os.Lstat(existing); err == nil {
+			// A dangling symlink, which could point anywhere once its target exists
+			return "", ErrUnsafe
+		}
+		if existing == root {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = filepath.Dir(existing)
+	}
+
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", ErrUnsafe
+	}
+	return path, nil
+}
+
+// isPathSeparator treats backslashes as separators too, so Windows-style
+// paths are checked the same way on every platform
+func isPathSeparator(r rune) bool {
+	return r == '/' || r == '\\'
+}
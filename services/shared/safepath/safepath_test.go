@@ -0,0 +1,93 @@
+package safepath
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	outside := filepath.Join(base, "outside")
+
+	for _, dir := range []string{filepath.Join(root, "uploads"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{filepath.Join(root, "uploads", "1_clip.mp4"), filepath.Join(outside, "secret")} {
+		if err := os.WriteFile(file, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"escape":      outside,
+		"escape_file": filepath.Join(outside, "secret"),
+		"inside":      filepath.Join(root, "uploads"),
+		"to_root":     root,
+		"dangling":    filepath.Join(outside, "missing"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string // relative to root
+		wantErr error
+	}{
+		{"plain file", "uploads/1_clip.mp4", "uploads/1_clip.mp4", nil},
+		{"directory", "uploads", "uploads", nil},
+		{"missing file", "uploads/2_missing.mp4", "uploads/2_missing.mp4", nil},
+		{"missing directory", "archive/1_clip.mp4", "archive/1_clip.mp4", nil},
+		{"symlink inside root", "inside/1_clip.mp4", "uploads/1_clip.mp4", nil},
+
+		{"empty", "", "", ErrUnsafe},
+		{"parent", "..", "", ErrUnsafe},
+		{"parent prefix", "../outside/secret", "", ErrUnsafe},
+		{"parent in the middle", "uploads/../../outside/secret", "", ErrUnsafe},
+		{"parent that stays inside", "uploads/../uploads/1_clip.mp4", "", ErrUnsafe},
+		{"backslash parent", `..\outside\secret`, "", ErrUnsafe},
+		{"current directory", ".", "", ErrUnsafe},
+		{"hidden file", ".hashes", "", ErrUnsafe},
+		{"hidden element", "uploads/.secret", "", ErrUnsafe},
+		{"trash", ".trash/1_clip.mp4", "", ErrUnsafe},
+		{"absolute", "/etc/passwd", "", ErrUnsafe},
+		{"absolute inside root", filepath.Join(root, "uploads"), "", ErrUnsafe},
+		{"leading backslash", `\etc\passwd`, "", ErrUnsafe},
+		{"nul byte", "uploads/1_clip.mp4\x00.txt", "", ErrUnsafe},
+		{"symlink to outside", "escape/secret", "", ErrUnsafe},
+		{"symlink to outside file", "escape_file", "", ErrUnsafe},
+		{"missing file behind symlink", "escape/missing", "", ErrUnsafe},
+		{"symlink to root", "to_root", "", ErrUnsafe},
+		{"dangling symlink", "dangling", "", ErrUnsafe},
+	}
+
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Resolve(root, tt.path)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Resolve(%q) = %q, %v; want error %v", tt.path, got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve(%q) returned error %v", tt.path, err)
+			}
+			if want := filepath.Join(resolvedRoot, tt.want); got != want {
+				t.Fatalf("Resolve(%q) = %q; want %q", tt.path, got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+// Package videometa validates the user-editable metadata of a video. The
+// catalog service stores it, and the upload service checks the metadata sent
+// with an upload before accepting the file.
+package videometa
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Limits on user-supplied metadata
+const (
+	MaxTitleLength       = 200
+	MaxDescriptionLength = 5000
+	MaxTags              = 20
+	MaxTagLength         = 50
+	MaxOwnerLength       = 100
+)
+
+// Visibility values a video can have
+const (
+	VisibilityPublic   = "public"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPrivate  = "private"
+)
+
+// Update is the body of the catalog's PATCH /files/{id}; omitted fields are
+// left unchanged
+type Update struct {
+	Title       *string   `json:"title,omitempty"`
+	Description *string   `json:"description,omitempty"`
+	Tags        *[]string `json:"tags,omitempty"`
+	Owner       *string   `json:"owner,omitempty"`
+	Visibility  *string   `json:"visibility,omitempty"`
+}
+
+// Normalize trims the provided fields and normalizes the tags in place, and
+// returns an error describing the first field that is not valid
+func (u *Update) Normalize() error {
+	if u.Title != nil {
+		title := strings.TrimSpace(*u.Title)
+		if title == "" {
+			return fmt.Errorf("title must not be empty")
+		}
+		if len(title) > MaxTitleLength {
+			return fmt.Errorf("title must be at most %d characters", MaxTitleLength)
+		}
+		u.Title = &title
+	}
+
+	if u.Description != nil {
+		description := strings.TrimSpace(*u.Description)
+		if len(description) > MaxDescriptionLength {
+			return fmt.Errorf("description must be at most %d characters", MaxDescriptionLength)
+		}
+		u.Description = &description
+	}
+
+	if u.Tags != nil {
+		tags, err := NormalizeTags(*u.Tags)
+		if err != nil {
+			return err
+		}
+		u.Tags = &tags
+	}
+
+	if u.Owner != nil {
+		owner := strings.TrimSpace(*u.Owner)
+		if len(owner) > MaxOwnerLength {
+			return fmt.Errorf("owner must be at most %d characters", MaxOwnerLength)
+		}
+		u.Owner = &owner
+	}
+
+	if u.Visibility != nil {
+		switch *u.Visibility {
+		case VisibilityPublic, VisibilityUnlisted, VisibilityPrivate:
+		default:
+			return fmt.Errorf("visibility must be one of %q, %q or %q",
+				VisibilityPublic, VisibilityUnlisted, VisibilityPrivate)
+		}
+	}
+
+	return nil
+}
+
+// NormalizeTags trims, lower-cases and de-duplicates tags, keeping their order
+func NormalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool, len(tags))
+	var normalized []string
+
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > MaxTagLength {
+			return nil, fmt.Errorf("tags must be at most %d characters", MaxTagLength)
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+
+	if len(normalized) > MaxTags {
+		return nil, fmt.Errorf("at most %d tags are allowed", MaxTags)
+	}
+	return normalized, nil
+}
@@ -52,7 +52,12 @@ describe('Upload Service API', () => {
         maxBodyLength: Infinity,
       });
       
-      expect(response.status).toBe(201);
+      // The sample may have been uploaded by an earlier run, in which case the
+      // existing file is returned instead of a new one
+      expect([200, 201]).toContain(response.status);
+      if (response.status === 200) {
+        expect(response.data.duplicate).toBe(true);
+      }
       expect(response.data).toHaveProperty('file_id');
       expect(response.data).toHaveProperty('filename');
       expect(response.data).toHaveProperty('size');
@@ -70,6 +75,49 @@ describe('Upload Service API', () => {
     }
   });
   
+  test('Uploading the same file twice should return the existing file', async () => {
+    // Skip if no sample file
+    if (!sampleFile) {
+      console.warn('No sample file available, skipping test');
+      return;
+    }
+    
+    const upload = () => {
+      const formData = new FormData();
+      formData.append('file', fs.createReadStream(sampleFile));
+      
+      return axios.post(`${UPLOAD_SERVICE_URL}/upload`, formData, {
+        headers: {
+          ...formData.getHeaders(),
+        },
+        maxContentLength: Infinity,
+        maxBodyLength: Infinity,
+      });
+    };
+    
+    try {
+      // The first upload may itself be a duplicate of an earlier run
+      const first = await upload();
+      expect([200, 201]).toContain(first.status);
+      
+      // The second one always is
+      const second = await upload();
+      expect(second.status).toBe(200);
+      expect(second.data.duplicate).toBe(true);
+      expect(second.data.file_id).toBe(first.data.file_id);
+      expect(second.data.sha256).toBe(first.data.sha256);
+      
+    } catch (error) {
+      // If service is not running, mark as skipped rather than failed
+      if (axios.isAxiosError(error) && (error as ApiError).code === 'ECONNREFUSED') {
+        console.warn('Upload service is not running, skipping test');
+        return;
+      }
+      
+      throw error;
+    }
+  });
+  
   test('Upload endpoint should reject non-video files', async () => {
     // Create temporary text file
     const tempFile = path.join(__dirname, '../', 'temp-test-file.txt');
@@ -1,7 +1,7 @@
 "use client";
 
 import React, { useState, useEffect, useCallback } from 'react';
-import { getEncodingJobs, EncodingJob } from '../lib/api';
+import { getEncodingJobs, subscribeToEncodingEvents, EncodingJob } from '../lib/api';
 import { AlertCircle, CheckCircle2, Clock, Loader2 } from 'lucide-react';
 import { formatDistance } from 'date-fns';
 
@@ -45,13 +45,25 @@ const JobsSection: React.FC<JobsSectionProps> = ({
 
   useEffect(() => {
     fetchJobs();
-    
-    // Set up a polling interval to refresh jobs
-    const interval = setInterval(fetchJobs, 5000);
-    
-    return () => clearInterval(interval);
   }, [fetchJobs]);
 
+  // Apply job changes pushed by the encoding service instead of polling
+  useEffect(() => {
+    return subscribeToEncodingEvents({
+      onJob: (_type, job) => {
+        setJobs((current) => {
+          const others = current.filter((j) => j.id !== job.id);
+          return [job, ...others].sort((a, b) =>
+            new Date(b.created_at).getTime() - new Date(a.created_at).getTime()
+          );
+        });
+      },
+      onJobDeleted: (jobId) => {
+        setJobs((current) => current.filter((j) => j.id !== jobId));
+      },
+    });
+  }, []);
+
   // Refresh when shouldRefresh prop changes
   useEffect(() => {
     if (shouldRefresh) {
@@ -9,19 +9,50 @@ export interface VideoFile {
   mime_type: string;
   created_at: string;
   url: string;
+  title: string;
+  description?: string;
+  tags: string[];
+  owner?: string;
+  visibility: 'public' | 'unlisted' | 'private';
+  updated_at: string;
+  deleted_at?: string;
+  purge_at?: string;
 }
 
 export interface EncodingJob {
   id: string;
   source_file: string;
-  status: 'pending' | 'processing' | 'completed' | 'failed';
+  profile?: string;
+  status: 'pending' | 'processing' | 'completed' | 'failed' | 'cancelled';
   progress: number;
   error_message?: string;
+  error_code?: 'corrupt_input' | 'unsupported_codec' | 'disk_full' | 'killed' | 'timeout' | 'encoder_error' | 'internal';
+  log_url?: string;
+  attempts?: number;
+  next_retry_at?: string;
   created_at: string;
   started_at?: string;
   completed_at?: string;
   dash_manifest?: string;
   hls_manifest?: string;
+  thumbnail?: string;
+  duration?: number;
+  current_rendition?: string;
+  eta_seconds?: number;
+  owner?: string;
+  priority?: number;
+  queue_position?: number;
+  suspended?: boolean;
+}
+
+export interface Video extends VideoFile {
+  status: 'ready' | 'processing' | 'pending' | 'failed' | 'not_encoded' | 'unknown';
+  progress: number;
+  duration?: number;
+  thumbnail?: string;
+  dash_manifest?: string;
+  hls_manifest?: string;
+  encodings: EncodingJob[];
 }
 
 export interface VideoStream {
@@ -40,7 +71,10 @@ export interface UploadResponse {
   filename: string;
   size: number;
   mime_type: string;
+  sha256?: string;
   uploaded_at: string;
+  duplicate?: boolean;
+  encoding_job_id?: string;
 }
 
 // Upload Service API
@@ -71,6 +105,59 @@ export const getVideoFiles = async (): Promise<VideoFile[]> => {
   return response.json();
 };
 
+export const getVideos = async (): Promise<Video[]> => {
+  const response = await fetch(`${CATALOG_SERVICE_URL}/videos`);
+
+  if (!response.ok) {
+    throw new Error(`Failed to fetch videos: ${response.statusText}`);
+  }
+
+  return response.json();
+};
+
+export const getVideo = async (fileId: string): Promise<Video> => {
+  const response = await fetch(`${CATALOG_SERVICE_URL}/videos/${encodeURIComponent(fileId)}`);
+
+  if (!response.ok) {
+    throw new Error(`Failed to fetch video: ${response.statusText}`);
+  }
+
+  return response.json();
+};
+
+export const deleteVideo = async (fileId: string, permanent = false): Promise<void> => {
+  const query = permanent ? '?permanent=true' : '';
+  const response = await fetch(`${CATALOG_SERVICE_URL}/files/${encodeURIComponent(fileId)}${query}`, {
+    method: 'DELETE',
+  });
+
+  if (!response.ok) {
+    throw new Error(`Failed to delete video: ${response.statusText}`);
+  }
+};
+
+export const restoreVideo = async (fileId: string): Promise<VideoFile> => {
+  const response = await fetch(`${CATALOG_SERVICE_URL}/files/${encodeURIComponent(fileId)}/restore`, {
+    method: 'POST',
+  });
+
+  if (!response.ok) {
+    throw new Error(`Failed to restore video: ${response.statusText}`);
+  }
+
+  return response.json();
+};
+
+export const getTrash = async (): Promise<VideoFile[]> => {
+  const response = await fetch(`${CATALOG_SERVICE_URL}/trash`);
+
+  if (!response.ok) {
+    throw new Error(`Failed to fetch trash: ${response.statusText}`);
+  }
+
+  return response.json();
+};
+
 export const downloadVideo = (fileId: string): string => {
   return `${CATALOG_SERVICE_URL}/download/${fileId}`;
 };
@@ -116,6 +203,56 @@ export const getEncodingJob = async (jobId: string): Promise<EncodingJob> => {
   return response.json();
 };
 
+export type JobEventType =
+  | 'job.created'
+  | 'job.started'
+  | 'job.progress'
+  | 'job.completed'
+  | 'job.failed'
+  | 'job.cancelled'
+  | 'job.retried'
+  | 'job.suspended'
+  | 'job.resumed';
+
+const jobEventTypes: JobEventType[] = [
+  'job.created',
+  'job.started',
+  'job.progress',
+  'job.completed',
+  'job.failed',
+  'job.cancelled',
+  'job.retried',
+  'job.suspended',
+  'job.resumed',
+];
+
+export interface EncodingEventHandlers {
+  onJob?: (type: JobEventType, job: EncodingJob) => void;
+  onJobDeleted?: (jobId: string) => void;
+  onStreamPublished?: (stream: VideoStream) => void;
+}
+
+// Subscribes to the encoding service's event stream. The browser reconnects on
+// its own and the service replays missed events. Returns a function that closes
+// the stream.
+export const subscribeToEncodingEvents = (handlers: EncodingEventHandlers): (() => void) => {
+  const source = new EventSource(`${ENCODING_SERVICE_URL}/events`);
+
+  for (const type of jobEventTypes) {
+    source.addEventListener(type, (event) => {
+      handlers.onJob?.(type, JSON.parse((event as MessageEvent).data));
+    });
+  }
+  source.addEventListener('job.deleted', (event) => {
+    handlers.onJobDeleted?.(JSON.parse((event as MessageEvent).data).id);
+  });
+  source.addEventListener('stream.published', (event) => {
+    handlers.onStreamPublished?.(JSON.parse((event as MessageEvent).data));
+  });
+
+  return () => source.close();
+};
+
 export const getVideoStreams = async (): Promise<VideoStream[]> => {
   try {
     const response = await fetch(`${ENCODING_SERVICE_URL}/streams`);
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/superlive/shared/videometa"
+)
+
+// Catalog service that stores titles, descriptions and other video metadata
+var catalogServiceURL = strings.TrimRight(getEnv("CATALOG_SERVICE_URL", "http://localhost:8081"), "/")
+
+// metadataFields are the upload form fields (or tus metadata keys) forwarded to
+// the catalog service. tags is a comma-separated list.
+var metadataFields = []string{"title", "description", "tags", "owner", "visibility"}
+
+// metadataUpdate builds the catalog update from the metadata fields supplied
+// with an upload, validated by the same rules the catalog service applies.
+// The bool result reports whether any metadata was supplied.
+func metadataUpdate(fields map[string]string) (videometa.Update, bool, error) {
+	var update videometa.Update
+	supplied := false
+	for _, name := range metadataFields {
+		value, ok := fields[name]
+		if !ok {
+			continue
+		}
+		supplied = true
+		switch name {
+		case "title":
+			update.Title = &value
+		case "description":
+			update.Description = &value
+		case "tags":
+			tags := strings.Split(value, ",")
+			update.Tags = &tags
+		case "owner":
+			update.Owner = &value
+		case "visibility":
+			update.Visibility = &value
+		}
+	}
+
+	if err := update.Normalize(); err != nil {
+		return update, supplied, &validationError{
+			Status:  http.StatusBadRequest,
+			Code:    "invalid_metadata",
+			Message: "Invalid metadata: " + err.Error(),
+		}
+	}
+	return update, supplied, nil
+}
+
+// saveFileMetadata sends the metadata fields supplied with an upload to the
+// catalog service. It does nothing if no metadata was supplied.
+func saveFileMetadata(fileID string, fields map[string]string) error {
+	update, supplied, err := metadataUpdate(fields)
+	if err != nil || !supplied {
+		return err
+	}
+
+	body, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+
+	return withRetry("Catalog metadata update for "+fileID, func() (bool, error) {
+		return patchFileMetadata(fileID, body)
+	})
+}
+
+// patchFileMetadata sends a single PATCH /files/{id} request. The bool result
+// reports whether a failure is worth retrying.
+func patchFileMetadata(fileID string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPatch, catalogServiceURL+"/files/"+url.PathEscape(fileID), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("catalog service returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		// Client errors will not succeed on retry
+		retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retryable, err
+	}
+
+	return false, nil
+}
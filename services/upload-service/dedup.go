@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/superlive/shared/hashindex"
+)
+
+// hashes maps content hashes to stored file IDs. It lives on the shared media
+// volume so the encoding service's watcher consults the same index.
+var hashes = hashindex.New(uploadDir)
+
+// storeUpload moves a fully received file at tmpPath into uploadDir, unless a
+// file with the same content is already stored. In that case tmpPath is
+// discarded and the existing file is returned with Duplicate set.
+func storeUpload(tmpPath, filename, mimeType string, size int64, checksum string) (*UploadResponse, error) {
+	if existing, ok := hashes.Lookup(checksum); ok {
+		os.Remove(tmpPath)
+		log.Printf("Upload of %s is a duplicate of %s", filename, existing)
+		return duplicateResponse(existing, mimeType, checksum)
+	}
+
+	if err := validateVideoFile(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+
+	fileID, finalPath, err := uploadPath(filename)
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+
+	// Claim the file before it appears, so the encoding service's watcher leaves
+	// it to be submitted with the upload's settings; see releaseSubmitClaim
+	claimPath := submitClaimPathFor(finalPath)
+	if err := os.WriteFile(claimPath, nil, 0644); err != nil {
+		log.Printf("Error claiming %s for submission: %v", fileID, err)
+	}
+	if err := moveFile(tmpPath, finalPath); err != nil {
+		os.Remove(claimPath)
+		return nil, err
+	}
+
+	owner, err := hashes.Claim(checksum, fileID)
+	if err != nil {
+		// The file is stored; it just won't be deduplicated against
+		log.Printf("Error indexing %s: %v", fileID, err)
+	} else if owner != fileID {
+		// An identical upload finished first
+		os.Remove(finalPath)
+		os.Remove(claimPath)
+		log.Printf("Upload of %s is a duplicate of %s", filename, owner)
+		return duplicateResponse(owner, mimeType, checksum)
+	}
+
+	return &UploadResponse{
+		FileID:     fileID,
+		Filename:   filename,
+		Size:       size,
+		MimeType:   mimeType,
+		SHA256:     checksum,
+		UploadedAt: time.Now(),
+	}, nil
+}
+
+// duplicateResponse describes an already stored file
+func duplicateResponse(fileID, mimeType, checksum string) (*UploadResponse, error) {
+	info, err := os.Stat(filepath.Join(uploadDir, fileID))
+	if err != nil {
+		return nil, err
+	}
+
+	_, filename, _ := strings.Cut(fileID, "_")
+	return &UploadResponse{
+		FileID:     fileID,
+		Filename:   filename,
+		Size:       info.Size(),
+		MimeType:   mimeType,
+		SHA256:     checksum,
+		UploadedAt: info.ModTime(),
+		Duplicate:  true,
+	}, nil
+}
@@ -1,27 +1,38 @@
 package main
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
+
+	"github.com/superlive/shared/safepath"
 )
 
 const (
 	uploadDir     = "./media"
 	maxUploadSize = 1024 * 1024 * 1024 // 1GB
+	maxFieldSize  = 64 * 1024          // Non-file form fields
 )
 
 type UploadResponse struct {
-	FileID     string    `json:"file_id"`
-	Filename   string    `json:"filename"`
-	Size       int64     `json:"size"`
-	MimeType   string    `json:"mime_type"`
-	UploadedAt time.Time `json:"uploaded_at"`
+	FileID        string    `json:"file_id"`
+	Filename      string    `json:"filename"`
+	Size          int64     `json:"size"`
+	MimeType      string    `json:"mime_type"`
+	SHA256        string    `json:"sha256,omitempty"`
+	UploadedAt    time.Time `json:"uploaded_at"`
+	Duplicate     bool      `json:"duplicate,omitempty"`
+	EncodingJobID string    `json:"encoding_job_id,omitempty"`
 }
 
 func main() {
@@ -30,9 +41,18 @@ func main() {
 		log.Fatalf("Failed to create upload directory: %v", err)
 	}
 
+	// Create the directory for in-progress resumable uploads
+	if err := os.MkdirAll(partialDir, 0755); err != nil {
+		log.Fatalf("Failed to create partial upload directory: %v", err)
+	}
+
+	// Discard abandoned resumable uploads
+	go expireUploads()
+
 	// Set up HTTP server with CORS middleware
 	mux := http.NewServeMux()
 	mux.HandleFunc("/upload", uploadHandler)
+	mux.HandleFunc(tusPath, tusHandler)
 	mux.HandleFunc("/health", healthCheckHandler)
 
 	// Create server with CORS middleware
@@ -69,11 +89,14 @@ func corsMiddleware(next http.Handler) http.Handler {
 			w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
 		}
 
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, HEAD, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata")
+		w.Header().Set("Access-Control-Expose-Headers", "Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Offset, Upload-Length, Upload-Expires, Upload-File-Id, Upload-Encoding-Job-Id")
 
-		// Handle preflight OPTIONS request
-		if r.Method == http.MethodOptions {
+		// Handle preflight OPTIONS request. Plain OPTIONS requests to the tus
+		// endpoint are protocol discovery and go to the handler.
+		isPreflight := r.Header.Get("Access-Control-Request-Method") != ""
+		if r.Method == http.MethodOptions && (isPreflight || !strings.HasPrefix(r.URL.Path, tusPath)) {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
@@ -92,63 +115,183 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Validate content length
 	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
-	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
-		http.Error(w, "File too large or invalid multipart form", http.StatusBadRequest)
-		return
-	}
 
-	// Get file from request
-	file, handler, err := r.FormFile("file")
+	// Stream the multipart body part by part instead of buffering it to temp files
+	reader, err := r.MultipartReader()
 	if err != nil {
-		http.Error(w, "Error retrieving file from form", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "invalid_form", "Invalid multipart form")
 		return
 	}
-	defer file.Close()
 
-	// Basic validation for video files
-	contentType := handler.Header.Get("Content-Type")
-	if !isVideoContentType(contentType) {
-		http.Error(w, "Only video files are allowed", http.StatusBadRequest)
+	var response *UploadResponse
+	fields := make(map[string]string)
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			removeUploadedFile(response)
+			writeJSONError(w, http.StatusBadRequest, "invalid_form", "File too large or invalid multipart form")
+			return
+		}
+
+		// Small text fields such as the encoding profile
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxFieldSize))
+			part.Close()
+			if err != nil {
+				removeUploadedFile(response)
+				writeJSONError(w, http.StatusBadRequest, "invalid_form", "Invalid multipart form")
+				return
+			}
+			fields[part.FormName()] = string(value)
+			// Fields may follow the file, which is then discarded
+			if err := validateUploadFields(fields); err != nil {
+				removeUploadedFile(response)
+				writeValidationError(w, err)
+				return
+			}
+			continue
+		}
+
+		// Only the first "file" part is stored
+		if part.FormName() != "file" || response != nil {
+			part.Close()
+			continue
+		}
+
+		// Identify the container from its magic bytes rather than trusting the
+		// client-supplied Content-Type
+		body := bufio.NewReaderSize(part, sniffLength)
+		header, _ := body.Peek(sniffLength)
+		mimeType := sniffVideoType(header)
+		if mimeType == "" {
+			part.Close()
+			writeValidationError(w, errUnsupportedFormat)
+			return
+		}
+
+		filename := filepath.Base(part.FileName())
+		_, finalPath, err := uploadPath(filename)
+		if err != nil {
+			part.Close()
+			writeValidationError(w, err)
+			return
+		}
+		tmpPath := tempPathFor(finalPath)
+
+		size, checksum, err := writeTempFile(tmpPath, body)
+		part.Close()
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_form", "File too large or invalid multipart form")
+			log.Printf("Error receiving %s: %v", filename, err)
+			return
+		}
+
+		response, err = storeUpload(tmpPath, filename, mimeType, size, checksum)
+		if err != nil {
+			log.Printf("Rejected upload of %s: %v", filename, err)
+			var verr *validationError
+			if errors.As(err, &verr) {
+				writeValidationError(w, err)
+			} else {
+				writeJSONError(w, http.StatusInternalServerError, "internal_error", "Error saving file")
+			}
+			return
+		}
+	}
+
+	if response == nil {
+		writeJSONError(w, http.StatusBadRequest, "missing_file", "Form has no file field")
 		return
 	}
 
-	// Generate a unique filename
-	fileID := fmt.Sprintf("%d_%s", time.Now().UnixNano(), handler.Filename)
-	filePath := filepath.Join(uploadDir, fileID)
+	// Store title, tags and other metadata in the catalog. Duplicates keep the
+	// metadata of the file that was uploaded first.
+	if !response.Duplicate {
+		if err := saveFileMetadata(response.FileID, fields); err != nil {
+			log.Printf("Error saving metadata for %s: %v", response.FileID, err)
+		}
+	}
 
-	// Create destination file
-	dst, err := os.Create(filePath)
+	// Notify the encoding service; if it is unreachable the file watcher picks the file up later
+	jobID, err := notifyEncodingService(response.FileID, fields)
+	releaseSubmitClaim(response)
 	if err != nil {
-		http.Error(w, "Error creating destination file", http.StatusInternalServerError)
-		log.Printf("Error creating file: %v", err)
-		return
+		log.Printf("Error notifying encoding service about %s: %v", response.FileID, err)
+	} else {
+		response.EncodingJobID = jobID
+		log.Printf("Encoding job %s created for %s", jobID, response.FileID)
+	}
+
+	// Return success response; duplicates point at the file that was already stored
+	status := http.StatusCreated
+	if response.Duplicate {
+		status = http.StatusOK
 	}
-	defer dst.Close()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
 
-	// Copy file to destination
-	size, err := io.Copy(dst, file)
+// writeTempFile streams src into a new file at path, computing its size and
+// SHA-256 on the fly. The file is removed if writing fails.
+func writeTempFile(path string, src io.Reader) (int64, string, error) {
+	dst, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
 	if err != nil {
-		http.Error(w, "Error saving file", http.StatusInternalServerError)
-		log.Printf("Error copying file: %v", err)
-		return
+		return 0, "", err
 	}
 
-	// Prepare response
-	response := UploadResponse{
-		FileID:     fileID,
-		Filename:   handler.Filename,
-		Size:       size,
-		MimeType:   contentType,
-		UploadedAt: time.Now(),
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(dst, hasher), src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return 0, "", err
 	}
 
-	// Send notification to encoding service (to be implemented)
-	// TODO: Send notification to encoding service
+	return size, hex.EncodeToString(hasher.Sum(nil)), nil
+}
 
-	// Return success response
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(response)
+// tempPathFor returns the hidden in-progress name used while writing path.
+// Dot-prefixed .part files are ignored by the catalog and encoding services.
+func tempPathFor(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".part")
+}
+
+// submitClaimPathFor returns the hidden file marking an upload at path that is
+// about to be submitted for encoding. The encoding service's watcher does not
+// create jobs for claimed files.
+func submitClaimPathFor(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".submitting")
+}
+
+// releaseSubmitClaim removes the claim storeUpload put on a new file, once it
+// has been submitted for encoding or could not be
+func releaseSubmitClaim(response *UploadResponse) {
+	if response.Duplicate {
+		return
+	}
+	if err := os.Remove(submitClaimPathFor(filepath.Join(uploadDir, response.FileID))); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error releasing claim on %s: %v", response.FileID, err)
+	}
+}
+
+// removeUploadedFile deletes a file stored earlier in a request that later failed.
+// Duplicates refer to a previously stored file and are left alone.
+func removeUploadedFile(response *UploadResponse) {
+	if response == nil || response.Duplicate {
+		return
+	}
+	if err := os.Remove(filepath.Join(uploadDir, response.FileID)); err != nil {
+		log.Printf("Error removing %s: %v", response.FileID, err)
+	}
+	// Released only after the file is gone, so the watcher never picks it up
+	releaseSubmitClaim(response)
 }
 
 func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
@@ -158,24 +301,32 @@ func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
 }
 
-func isVideoContentType(contentType string) bool {
-	videoTypes := []string{
-		"video/mp4",
-		"video/mpeg",
-		"video/ogg",
-		"video/webm",
-		"video/quicktime",
-		"video/x-matroska",
-		"video/x-flv",
-		"video/x-ms-wmv",
-	}
-
-	for _, vt := range videoTypes {
-		if contentType == vt {
-			return true
-		}
+// newFileID generates the unique name an upload is stored under
+func newFileID(filename string) string {
+	return fmt.Sprintf("%d_%s", time.Now().UnixNano(), filename)
+}
+
+// errInvalidFilename is returned for client-supplied filenames an upload
+// cannot safely be stored under
+var errInvalidFilename = &validationError{
+	Status:  http.StatusBadRequest,
+	Code:    "invalid_filename",
+	Message: "Filename contains path elements that are not allowed",
+}
+
+// uploadPath returns a new file ID for an upload with the given client-supplied
+// filename and the path it is stored at. The ID is resolved like the file IDs
+// the other services get from clients, so it cannot reach outside uploadDir.
+func uploadPath(filename string) (string, string, error) {
+	fileID := newFileID(filename)
+	path, err := safepath.Resolve(uploadDir, fileID)
+	if err == safepath.ErrUnsafe {
+		return "", "", errInvalidFilename
+	}
+	if err != nil {
+		return "", "", err
 	}
-	return false
+	return fileID, path, nil
 }
 
 func getEnv(key, fallback string) string {
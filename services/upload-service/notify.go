@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Settings for notifying other services about new uploads
+var (
+	encodingServiceURL = strings.TrimRight(getEnv("ENCODING_SERVICE_URL", "http://localhost:8082"), "/")
+	notifyAttempts     = getEnvInt("ENCODING_NOTIFY_ATTEMPTS", 3)
+	notifyBackoff      = time.Second
+	notifyClient       = &http.Client{Timeout: 10 * time.Second}
+)
+
+// encodeRequest is the body sent to the encoding service's /encode endpoint
+type encodeRequest struct {
+	SourceFile string `json:"source_file"`
+	Profile    string `json:"profile,omitempty"`
+	Owner      string `json:"owner,omitempty"`
+	Priority   *int   `json:"priority,omitempty"`
+}
+
+// encodeResponse is the subset of the created encoding job we care about
+type encodeResponse struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// notifyEncodingService asks the encoding service to encode an uploaded file,
+// retrying with exponential backoff. The profile, owner and priority fields of
+// the upload are passed along. It returns the ID of the encoding job.
+func notifyEncodingService(fileID string, fields map[string]string) (string, error) {
+	request := encodeRequest{
+		SourceFile: fileID,
+		Profile:    fields["profile"],
+		Owner:      strings.TrimSpace(fields["owner"]),
+	}
+	priority, err := parsePriority(fields)
+	if err != nil {
+		return "", err
+	}
+	request.Priority = priority
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+
+	var jobID string
+	err = withRetry("Encoding notification for "+fileID, func() (bool, error) {
+		id, retryable, err := postEncodeRequest(body)
+		jobID = id
+		return retryable, err
+	})
+	return jobID, err
+}
+
+// Range of encoding priorities accepted by the encoding service
+const (
+	minPriority = -100
+	maxPriority = 100
+)
+
+// parsePriority returns the priority field of an upload, or nil if none was given
+func parsePriority(fields map[string]string) (*int, error) {
+	value, ok := fields["priority"]
+	if !ok {
+		return nil, nil
+	}
+	priority, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || priority < minPriority || priority > maxPriority {
+		return nil, &validationError{
+			Status:  http.StatusBadRequest,
+			Code:    "invalid_priority",
+			Message: fmt.Sprintf("Priority must be a whole number between %d and %d", minPriority, maxPriority),
+		}
+	}
+	return &priority, nil
+}
+
+// withRetry calls send until it succeeds, reports a non-retryable failure or
+// notifyAttempts is reached, backing off exponentially between attempts
+func withRetry(desc string, send func() (bool, error)) error {
+	backoff := notifyBackoff
+	var lastErr error
+
+	for attempt := 1; attempt <= notifyAttempts; attempt++ {
+		retryable, err := send()
+		if err == nil {
+			return nil
+		}
+
+		lastErr = err
+		if !retryable {
+			break
+		}
+
+		log.Printf("%s failed (attempt %d/%d): %v", desc, attempt, notifyAttempts, err)
+		if attempt < notifyAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	return lastErr
+}
+
+// postEncodeRequest sends a single /encode request. The bool result reports
+// whether a failure is worth retrying.
+func postEncodeRequest(body []byte) (string, bool, error) {
+	resp, err := notifyClient.Post(encodingServiceURL+"/encode", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("encoding service returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		// Client errors will not succeed on retry
+		retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return "", retryable, err
+	}
+
+	var job encodeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return "", true, fmt.Errorf("invalid response from encoding service: %w", err)
+	}
+
+	return job.ID, false, nil
+}
+
+func getEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(getEnv(key, ""))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/superlive/shared/hashindex"
+)
+
+// tus resumable upload protocol (https://tus.io/protocols/resumable-upload)
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+	tusPath       = "/uploads/"
+
+	// Partial uploads live outside uploadDir so the encoding watcher never sees them
+	partialDir = "./uploads"
+
+	// Unfinished uploads are discarded after this long without activity
+	tusExpiry = 24 * time.Hour
+)
+
+// tusUpload is the persisted state of a resumable upload
+type tusUpload struct {
+	ID        string            `json:"id"`
+	Length    int64             `json:"length"`
+	Metadata  map[string]string `json:"metadata"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+
+	// Set once the upload has been moved into uploadDir
+	Completed bool            `json:"completed"`
+	Result    *UploadResponse `json:"result,omitempty"`
+}
+
+// Per-upload locks so concurrent PATCH requests cannot interleave writes
+var (
+	tusLocks   = make(map[string]*sync.Mutex)
+	tusLocksMu sync.Mutex
+)
+
+// tusHandler dispatches tus protocol requests under /uploads/
+func tusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxUploadSize, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, tusPath), "/")
+
+	if id == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		tusCreateHandler(w, r)
+		return
+	}
+
+	if !isValidUploadID(id) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		tusHeadHandler(w, r, id)
+	case http.MethodPatch:
+		tusPatchHandler(w, r, id)
+	case http.MethodDelete:
+		tusDeleteHandler(w, r, id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// tusCreateHandler creates a new upload (creation extension)
+func tusCreateHandler(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Upload-Length header is required", http.StatusBadRequest)
+		return
+	}
+	if length > maxUploadSize {
+		http.Error(w, "Upload exceeds maximum size", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "Invalid Upload-Metadata header", http.StatusBadRequest)
+		return
+	}
+
+	filename := filepath.Base(metadata["filename"])
+	if filename == "." || filename == string(filepath.Separator) || filename == "" {
+		http.Error(w, "filename metadata is required", http.StatusBadRequest)
+		return
+	}
+	if _, _, err := uploadPath(filename); err != nil {
+		http.Error(w, "Invalid filename metadata", http.StatusBadRequest)
+		return
+	}
+	metadata["filename"] = filename
+	if err := validateUploadFields(metadata); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		http.Error(w, "Error creating upload", http.StatusInternalServerError)
+		log.Printf("Error generating upload ID: %v", err)
+		return
+	}
+
+	now := time.Now()
+	upload := &tusUpload{
+		ID:        id,
+		Length:    length,
+		Metadata:  metadata,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	f, err := os.OpenFile(partialDataPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		http.Error(w, "Error creating upload", http.StatusInternalServerError)
+		log.Printf("Error creating partial upload file: %v", err)
+		return
+	}
+	f.Close()
+
+	if err := saveUploadInfo(upload); err != nil {
+		os.Remove(partialDataPath(id))
+		http.Error(w, "Error creating upload", http.StatusInternalServerError)
+		log.Printf("Error saving upload info: %v", err)
+		return
+	}
+
+	log.Printf("Created resumable upload %s for %s (%d bytes)", id, filename, length)
+
+	w.Header().Set("Location", tusPath+id)
+	w.Header().Set("Upload-Expires", upload.expiresAt().UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// tusHeadHandler reports the current offset of an upload
+func tusHeadHandler(w http.ResponseWriter, r *http.Request, id string) {
+	upload, offset, err := loadUpload(id)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if !upload.Completed {
+		w.Header().Set("Upload-Expires", upload.expiresAt().UTC().Format(http.TimeFormat))
+	}
+	setUploadResultHeaders(w, upload)
+	w.WriteHeader(http.StatusOK)
+}
+
+// tusPatchHandler appends a chunk to an upload and finalizes it once complete
+func tusPatchHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	clientOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || clientOffset < 0 {
+		http.Error(w, "Upload-Offset header is required", http.StatusBadRequest)
+		return
+	}
+
+	lock := uploadLock(id)
+	if !lock.TryLock() {
+		http.Error(w, "Upload is already being written", http.StatusLocked)
+		return
+	}
+	defer lock.Unlock()
+
+	upload, offset, err := loadUpload(id)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if upload.Completed {
+		http.Error(w, "Upload is already complete", http.StatusForbidden)
+		return
+	}
+	if clientOffset != offset {
+		http.Error(w, "Upload-Offset does not match current offset", http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(partialDataPath(id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		http.Error(w, "Error writing upload", http.StatusInternalServerError)
+		log.Printf("Error opening partial upload %s: %v", id, err)
+		return
+	}
+
+	// Never accept more than the declared length. A dropped connection keeps
+	// whatever was received, so the client can resume from the new offset.
+	written, copyErr := io.Copy(f, io.LimitReader(r.Body, upload.Length-offset))
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	offset += written
+
+	upload.UpdatedAt = time.Now()
+	if err := saveUploadInfo(upload); err != nil {
+		log.Printf("Error saving upload info for %s: %v", id, err)
+	}
+
+	if copyErr != nil {
+		log.Printf("Upload %s interrupted at offset %d: %v", id, offset, copyErr)
+		http.Error(w, "Error writing upload", http.StatusInternalServerError)
+		return
+	}
+
+	if offset == upload.Length {
+		if err := finalizeUpload(upload); err != nil {
+			log.Printf("Error finalizing upload %s: %v", id, err)
+			var verr *validationError
+			if errors.As(err, &verr) {
+				writeValidationError(w, err)
+			} else {
+				http.Error(w, "Error finalizing upload", http.StatusInternalServerError)
+			}
+			return
+		}
+		setUploadResultHeaders(w, upload)
+	} else {
+		w.Header().Set("Upload-Expires", upload.expiresAt().UTC().Format(http.TimeFormat))
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusDeleteHandler discards an upload (termination extension)
+func tusDeleteHandler(w http.ResponseWriter, r *http.Request, id string) {
+	lock := uploadLock(id)
+	if !lock.TryLock() {
+		http.Error(w, "Upload is being written", http.StatusLocked)
+		return
+	}
+	defer lock.Unlock()
+
+	if _, _, err := loadUpload(id); err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	removeUpload(id)
+	log.Printf("Terminated resumable upload %s", id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finalizeUpload validates a complete upload, moves it into uploadDir and
+// notifies the encoding service. Uploads that are not valid video are discarded.
+func finalizeUpload(upload *tusUpload) error {
+	dataPath := partialDataPath(upload.ID)
+
+	mimeType, err := sniffVideoFile(dataPath)
+	if err != nil {
+		return err
+	}
+	if mimeType == "" {
+		removeUpload(upload.ID)
+		return errUnsupportedFormat
+	}
+
+	checksum, err := hashindex.HashFile(dataPath)
+	if err != nil {
+		return err
+	}
+
+	response, err := storeUpload(dataPath, upload.Metadata["filename"], mimeType, upload.Length, checksum)
+	if err != nil {
+		var verr *validationError
+		if errors.As(err, &verr) {
+			removeUpload(upload.ID)
+		}
+		return err
+	}
+	fileID := response.FileID
+
+	if !response.Duplicate {
+		if err := saveFileMetadata(fileID, upload.Metadata); err != nil {
+			log.Printf("Error saving metadata for %s: %v", fileID, err)
+		}
+	}
+
+	jobID, err := notifyEncodingService(fileID, upload.Metadata)
+	releaseSubmitClaim(response)
+	if err != nil {
+		log.Printf("Error notifying encoding service about %s: %v", fileID, err)
+	} else {
+		response.EncodingJobID = jobID
+		log.Printf("Encoding job %s created for %s", jobID, fileID)
+	}
+
+	upload.Completed = true
+	upload.Result = response
+	upload.UpdatedAt = time.Now()
+	if err := saveUploadInfo(upload); err != nil {
+		log.Printf("Error saving upload info for %s: %v", upload.ID, err)
+	}
+
+	log.Printf("Resumable upload %s completed as %s", upload.ID, fileID)
+	return nil
+}
+
+// setUploadResultHeaders exposes the stored file ID of a completed upload
+func setUploadResultHeaders(w http.ResponseWriter, upload *tusUpload) {
+	if upload.Result == nil {
+		return
+	}
+	w.Header().Set("Upload-File-Id", upload.Result.FileID)
+	if upload.Result.EncodingJobID != "" {
+		w.Header().Set("Upload-Encoding-Job-Id", upload.Result.EncodingJobID)
+	}
+}
+
+// loadUpload reads an upload's state and its current offset
+func loadUpload(id string) (*tusUpload, int64, error) {
+	data, err := os.ReadFile(partialInfoPath(id))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var upload tusUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, 0, fmt.Errorf("corrupt upload info: %w", err)
+	}
+
+	if upload.Completed {
+		return &upload, upload.Length, nil
+	}
+
+	info, err := os.Stat(partialDataPath(id))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &upload, info.Size(), nil
+}
+
+// saveUploadInfo atomically writes an upload's state next to its data
+func saveUploadInfo(upload *tusUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := partialInfoPath(upload.ID) + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, partialInfoPath(upload.ID))
+}
+
+// removeUpload deletes all files belonging to an upload
+func removeUpload(id string) {
+	os.Remove(partialDataPath(id))
+	os.Remove(partialInfoPath(id))
+
+	tusLocksMu.Lock()
+	delete(tusLocks, id)
+	tusLocksMu.Unlock()
+}
+
+// expireUploads periodically removes uploads that have not been touched within tusExpiry
+func expireUploads() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		infos, err := filepath.Glob(filepath.Join(partialDir, "*.info"))
+		if err != nil {
+			log.Printf("Error listing partial uploads: %v", err)
+		}
+
+		for _, infoPath := range infos {
+			id := strings.TrimSuffix(filepath.Base(infoPath), ".info")
+			upload, _, err := loadUpload(id)
+			if err != nil || time.Now().After(upload.expiresAt()) {
+				log.Printf("Expiring resumable upload %s", id)
+				removeUpload(id)
+			}
+		}
+
+		<-ticker.C
+	}
+}
+
+func (u *tusUpload) expiresAt() time.Time {
+	return u.UpdatedAt.Add(tusExpiry)
+}
+
+func uploadLock(id string) *sync.Mutex {
+	tusLocksMu.Lock()
+	defer tusLocksMu.Unlock()
+
+	lock, ok := tusLocks[id]
+	if !ok {
+		lock = &sync.Mutex{}
+		tusLocks[id] = lock
+	}
+	return lock
+}
+
+func partialDataPath(id string) string {
+	return filepath.Join(partialDir, id+".bin")
+}
+
+func partialInfoPath(id string) string {
+	return filepath.Join(partialDir, id+".info")
+}
+
+// newUploadID returns a random hex identifier for an upload
+func newUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// isValidUploadID rejects IDs that are not ones we generated
+func isValidUploadID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// parseUploadMetadata decodes a tus Upload-Metadata header ("key base64,key base64")
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata value for %s: %w", key, err)
+		}
+		metadata[key] = string(value)
+	}
+
+	return metadata, nil
+}
+
+// moveFile moves src to dst, copying via a hidden temp file in the destination
+// directory when they are on different filesystems
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmpPath := tempPathFor(dst)
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, dst); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Remove(src)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits applied when validating uploaded media
+const (
+	sniffLength       = 512
+	probeTimeout      = 60 * time.Second
+	maxVideoDuration  = 12 * time.Hour
+	minVideoDimension = 16
+	maxVideoDimension = 8192
+)
+
+// validationError explains why an uploaded file was rejected
+type validationError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *validationError) Error() string {
+	return e.Message
+}
+
+// errorResponse is the JSON body returned when a request is rejected
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// writeJSONError sends a structured error response
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: message, Code: code})
+}
+
+// writeValidationError sends a validationError, or a generic 500 for any other error
+func writeValidationError(w http.ResponseWriter, err error) {
+	var verr *validationError
+	if errors.As(err, &verr) {
+		writeJSONError(w, verr.Status, verr.Code, verr.Message)
+		return
+	}
+	writeJSONError(w, http.StatusInternalServerError, "internal_error", "Error validating file")
+}
+
+// validateUploadFields checks the form fields (or tus metadata) sent with an
+// upload, so a file is never accepted with settings that would be rejected later
+func validateUploadFields(fields map[string]string) error {
+	if _, err := parsePriority(fields); err != nil {
+		return err
+	}
+	_, _, err := metadataUpdate(fields)
+	return err
+}
+
+// sniffVideoType identifies a video container from its leading bytes and
+// returns its MIME type, or "" if the data is not a recognised video format
+func sniffVideoType(header []byte) string {
+	switch {
+	case len(header) >= 12 && string(header[4:8]) == "ftyp":
+		if string(header[8:12]) == "qt  " {
+			return "video/quicktime"
+		}
+		return "video/mp4"
+	case len(header) >= 8 && isQuickTimeAtom(string(header[4:8])):
+		return "video/quicktime"
+	case bytes.HasPrefix(header, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		// Matroska and WebM share the EBML header; the DocType tells them apart
+		if bytes.Contains(header, []byte("webm")) {
+			return "video/webm"
+		}
+		return "video/x-matroska"
+	case len(header) >= 12 && string(header[0:4]) == "RIFF" && string(header[8:12]) == "AVI ":
+		return "video/x-msvideo"
+	case bytes.HasPrefix(header, []byte("FLV\x01")):
+		return "video/x-flv"
+	case bytes.HasPrefix(header, []byte{0x30, 0x26, 0xB2, 0x75, 0x8E, 0x66, 0xCF, 0x11}):
+		return "video/x-ms-wmv"
+	case bytes.HasPrefix(header, []byte{0x00, 0x00, 0x01, 0xBA}), bytes.HasPrefix(header, []byte{0x00, 0x00, 0x01, 0xB3}):
+		return "video/mpeg"
+	case len(header) > 188 && header[0] == 0x47 && header[188] == 0x47:
+		return "video/mp2t"
+	case bytes.HasPrefix(header, []byte("OggS")):
+		return "video/ogg"
+	default:
+		return ""
+	}
+}
+
+// isQuickTimeAtom reports whether name is a top-level atom that can start a
+// QuickTime file written without an ftyp atom
+func isQuickTimeAtom(name string) bool {
+	switch name {
+	case "moov", "mdat", "wide", "free", "skip":
+		return true
+	default:
+		return false
+	}
+}
+
+// sniffVideoFile reads the start of a file and identifies its container
+func sniffVideoFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, sniffLength)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return sniffVideoType(header[:n]), nil
+}
+
+// errUnsupportedFormat is returned when sniffing finds no known video container
+var errUnsupportedFormat = &validationError{
+	Status:  http.StatusUnsupportedMediaType,
+	Code:    "unsupported_format",
+	Message: "File is not a recognised video format",
+}
+
+// probeResult holds the subset of ffprobe output used for validation
+type probeResult struct {
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+		CodecName string `json:"codec_name"`
+		Width     int    `json:"width"`
+		Height    int    `json:"height"`
+	} `json:"streams"`
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+}
+
+// validateVideoFile checks with ffprobe that a file has a video stream with
+// sane dimensions and duration, and that its first frame can be decoded
+func validateVideoFile(path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	output, err := runMediaTool(ctx, path, "ffprobe",
+		"-v", "error",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		path,
+	)
+	if err != nil {
+		return err
+	}
+
+	var probe probeResult
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return fmt.Errorf("unexpected ffprobe output: %w", err)
+	}
+
+	hasVideo := false
+	for _, s := range probe.Streams {
+		if s.CodecType != "video" {
+			continue
+		}
+		hasVideo = true
+
+		if s.CodecName == "" {
+			return invalidMedia("no_video_stream", "Video stream uses an unknown codec")
+		}
+		if s.Width < minVideoDimension || s.Height < minVideoDimension ||
+			s.Width > maxVideoDimension || s.Height > maxVideoDimension {
+			return invalidMedia("invalid_dimensions", fmt.Sprintf(
+				"Video dimensions %dx%d are outside the supported range of %d to %d pixels",
+				s.Width, s.Height, minVideoDimension, maxVideoDimension))
+		}
+		break
+	}
+	if !hasVideo {
+		return invalidMedia("no_video_stream", "File does not contain a video stream")
+	}
+
+	duration, err := strconv.ParseFloat(probe.Format.Duration, 64)
+	if err != nil || duration <= 0 {
+		return invalidMedia("invalid_duration", "Video duration could not be determined")
+	}
+	if duration > maxVideoDuration.Seconds() {
+		return invalidMedia("invalid_duration", fmt.Sprintf(
+			"Video is longer than the maximum of %s", maxVideoDuration))
+	}
+
+	// Decode a single frame to make sure the stream is actually playable
+	if _, err := runMediaTool(ctx, path, "ffmpeg",
+		"-v", "error",
+		"-i", path,
+		"-map", "0:v:0",
+		"-frames:v", "1",
+		"-f", "null", "-",
+	); err != nil {
+		var verr *validationError
+		if errors.As(err, &verr) {
+			verr.Code = "undecodable_video"
+			verr.Message = "Video stream could not be decoded: " + verr.Message
+		}
+		return err
+	}
+
+	return nil
+}
+
+// runMediaTool runs ffprobe or ffmpeg on path and returns its stdout. A non-zero
+// exit means the tool rejected the file and is reported as a validationError.
+func runMediaTool(ctx context.Context, path, name string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if ctx.Err() != nil {
+		return nil, invalidMedia("invalid_media", "Timed out while inspecting the file")
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = "file could not be read"
+		}
+		// The first line is enough to explain the problem; the server-side path is not
+		msg, _, _ = strings.Cut(msg, "\n")
+		msg = strings.TrimPrefix(msg, path+": ")
+		return nil, invalidMedia("invalid_media", msg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to run %s: %w", name, err)
+	}
+
+	return output, nil
+}
+
+// invalidMedia builds a validationError for a file that is not usable video
+func invalidMedia(code, message string) *validationError {
+	return &validationError{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    code,
+		Message: message,
+	}
+}